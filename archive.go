@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// getArchiveImage reads the image with the given tag from a tarball created
+// with docker save. Without a tag the archive has to contain a single image
+// or all images of the archive are returned as an image index, where each
+// manifest carries its tag in the org.opencontainers.image.ref.name
+// annotation. Images with multiple tags appear once per tag, patchIndex
+// patches them only once. The returned name is the tag of the image. It is
+// empty for an untagged image and for multiple images.
+func getArchiveImage(path string, tag string) (mutate.Appendable, string, error) {
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+
+	if tag != "" {
+		t, err := name.NewTag(tag)
+		if err != nil {
+			return nil, "", err
+		}
+		img, err := tarball.Image(opener, &t)
+		return img, tag, err
+	}
+
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(manifest) == 1 {
+		img, err := tarball.Image(opener, nil)
+		if err != nil || len(manifest[0].RepoTags) == 0 {
+			return img, "", err
+		}
+		return img, manifest[0].RepoTags[0], nil
+	}
+
+	adds := []mutate.IndexAddendum{}
+	for _, desc := range manifest {
+		if len(desc.RepoTags) == 0 {
+			return nil, "", fmt.Errorf("%s: archive contains multiple images and image %s has no tag", path, desc.Config)
+		}
+
+		t, err := name.NewTag(desc.RepoTags[0])
+		if err != nil {
+			return nil, "", err
+		}
+		img, err := tarball.Image(opener, &t)
+		if err != nil {
+			return nil, "", err
+		}
+
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, repoTag := range desc.RepoTags {
+			adds = append(adds, mutate.IndexAddendum{
+				Add: img,
+				Descriptor: v1.Descriptor{
+					Platform: cfg.Platform(),
+					Annotations: map[string]string{
+						refNameAnnotation: repoTag,
+					},
+				},
+			})
+		}
+	}
+	return mutate.AppendManifests(empty.Index, adds...), "", nil
+}
+
+// checkMultiImageDestinations returns an error if one of the destinations
+// cannot hold the images of a multi-image archive. A registry would get the
+// unrelated images as one multi-platform index and the docker daemon only
+// takes a single image.
+func checkMultiImageDestinations(refs []*reference) error {
+	for _, ref := range refs {
+		switch ref.transport {
+		case transportRegistry, transportDaemon:
+			return fmt.Errorf("the images of a multi-image archive cannot be written to '%s', select an image with %s:PATH:REFERENCE", ref, transportArchive)
+		}
+	}
+	return nil
+}
+
+// putArchiveImage writes an image into a tarball which can be loaded with
+// docker load. If img is an index which was read from a multi-image archive
+// (see getArchiveImage) all images are written with their tags. Otherwise the
+// image is written with the given tag or untagged if the tag is empty.
+// Existing files get overwritten.
+func putArchiveImage(path string, tag string, img mutate.Appendable) error {
+	refToImage := map[name.Reference]v1.Image{}
+
+	if idx, ok := img.(v1.ImageIndex); ok {
+		tagged, err := taggedImages(idx)
+		if err != nil {
+			return err
+		}
+		if tagged != nil {
+			if tag != "" {
+				return fmt.Errorf("the images of a multi-image archive keep their tags, remove the reference '%s' from the destination", tag)
+			}
+			return tarball.MultiRefWriteToFile(path, tagged)
+		}
+
+		img, err = singleImage(idx)
+		if err != nil {
+			return fmt.Errorf("docker-archive does not support image indexes: %w", err)
+		}
+	}
+
+	image := img.(v1.Image)
+	if tag == "" {
+		// Only tags end up in the manifest.json of the archive, hence a
+		// digest reference writes an untagged image.
+		digest, err := image.Digest()
+		if err != nil {
+			return err
+		}
+		ref, err := name.NewDigest("untagged@" + digest.String())
+		if err != nil {
+			return err
+		}
+		refToImage[ref] = image
+	} else {
+		t, err := name.NewTag(tag)
+		if err != nil {
+			return err
+		}
+		refToImage[t] = image
+	}
+	return tarball.MultiRefWriteToFile(path, refToImage)
+}
+
+// taggedImages returns the images of an index which have a tag in their
+// org.opencontainers.image.ref.name annotation. If not all manifests have a
+// tag nil is returned.
+func taggedImages(idx v1.ImageIndex) (map[name.Reference]v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	refToImage := map[name.Reference]v1.Image{}
+	images := map[v1.Hash]v1.Image{}
+	for _, desc := range manifest.Manifests {
+		refName, ok := desc.Annotations[refNameAnnotation]
+		if !ok {
+			return nil, nil
+		}
+		tag, err := name.NewTag(refName)
+		if err != nil {
+			return nil, nil
+		}
+
+		// use the same image for all tags to write it only once
+		img, ok := images[desc.Digest]
+		if !ok {
+			img, err = idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			images[desc.Digest] = img
+		}
+		refToImage[tag] = img
+	}
+	return refToImage, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestArchiveImage(t *testing.T) {
+	dir := t.TempDir()
+
+	debian, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpine, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "images.tar")
+	err = tarball.MultiRefWriteToFile(src, map[name.Reference]v1.Image{
+		name.MustParseReference("debian:12"):     debian,
+		name.MustParseReference("debian:latest"): debian,
+		name.MustParseReference("alpine:3.18"):   alpine,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, srcName, err := getArchiveImage(src, "alpine:3.18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameDigest(t, img, alpine) {
+		t.Error("got wrong image for tag alpine:3.18")
+	}
+	if srcName != "alpine:3.18" {
+		t.Errorf("got name '%s' for tag alpine:3.18", srcName)
+	}
+
+	all, srcName, err := getArchiveImage(src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcName != "" {
+		t.Errorf("got name '%s' for multi-image archive", srcName)
+	}
+	idx, ok := all.(v1.ImageIndex)
+	if !ok {
+		t.Fatalf("got %T for multi-image archive", all)
+	}
+	tagged, err := taggedImages(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 3 {
+		t.Fatalf("got %d tagged images, want 3", len(tagged))
+	}
+
+	// the image with two tags is patched once
+	patched := 0
+	newIdx, err := patchIndex(idx, nil, func(img v1.Image) (v1.Image, error) {
+		patched++
+		return mutate.Config(img, v1.Config{Labels: map[string]string{"patched": "true"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched != 2 {
+		t.Errorf("patched %d images, want 2", patched)
+	}
+
+	dst := filepath.Join(dir, "patched.tar")
+	err = putArchiveImage(dst, "", newIdx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := archiveTags(t, dst), [][]string{{"alpine:3.18"}, {"debian:12", "debian:latest"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+
+	err = putArchiveImage(dst, "debian:13", newIdx)
+	if err == nil {
+		t.Error("expected error for a reference with a multi-image archive")
+	}
+
+	err = putArchiveImage(dst, "", debian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := archiveTags(t, dst), [][]string{{}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v, want %v", got, want)
+	}
+	img, srcName, err = getArchiveImage(dst, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameDigest(t, img, debian) {
+		t.Error("got wrong image from untagged archive")
+	}
+	if srcName != "" {
+		t.Errorf("got name '%s' for archive without tag", srcName)
+	}
+
+	// a single image is named by its tag without a tag in the reference
+	err = putArchiveImage(dst, "debian:13", debian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, srcName, err = getArchiveImage(dst, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := sourceName(&reference{transport: transportArchive, location: dst}, srcName)
+	if ref == nil || ref.Name() != "index.docker.io/library/debian:13" {
+		t.Errorf("got source name %v for single-image archive", ref)
+	}
+}
+
+func TestCheckMultiImageDestinations(t *testing.T) {
+	for dst, ok := range map[string]bool{
+		"docker-archive:patched.tar":    true,
+		"oci:mirror":                    true,
+		"registry.mycompany.com/debian": false,
+		"docker-daemon:debian:12":       false,
+	} {
+		ref, err := parseReference(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkMultiImageDestinations([]*reference{ref})
+		if (err == nil) != ok {
+			t.Errorf("%s: got error %v", dst, err)
+		}
+	}
+}
+
+func sameDigest(t *testing.T, a, b mutate.Appendable) bool {
+	t.Helper()
+	da, err := a.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := b.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return da == db
+}
+
+// archiveTags returns the sorted tags of every image in an archive.
+func archiveTags(t *testing.T, path string) [][]string {
+	t.Helper()
+	manifest, err := tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := [][]string{}
+	for _, desc := range manifest {
+		repoTags := append([]string{}, desc.RepoTags...)
+		sort.Strings(repoTags)
+		tags = append(tags, repoTags)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return len(tags[i]) > 0 && len(tags[j]) > 0 && tags[i][0] < tags[j][0]
+	})
+	return tags
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// credentials configure the authentication against the source or the
+// destination registry. If none of the fields is set, the default keychain
+// (docker config.json) is used.
+type credentials struct {
+	username string
+	password string
+	token    string
+	// authFile is the path of an alternate docker config.json.
+	authFile string
+}
+
+// setCreds sets username and password from a USERNAME[:PASSWORD] string.
+// It is used as flag.Func and must not return the value in its errors.
+func (c *credentials) setCreds(value string) error {
+	username, password, _ := strings.Cut(value, ":")
+	if username == "" {
+		return fmt.Errorf("username missing, use USERNAME[:PASSWORD]")
+	}
+	c.username = username
+	c.password = password
+	return nil
+}
+
+// fromEnv reads the credentials from the environment variables
+// <prefix>_USERNAME, <prefix>_PASSWORD, <prefix>_TOKEN and
+// <prefix>_AUTHFILE. If credentials are configured with options, the
+// environment is ignored, so that a leftover variable does not override
+// them. Only the password of a username without password is taken from
+// <prefix>_PASSWORD, which keeps it out of the process list.
+func (c *credentials) fromEnv(prefix string) {
+	getenv := func(key string) string {
+		return os.Getenv(prefix + "_" + key)
+	}
+	if c.username != "" || c.token != "" || c.authFile != "" {
+		if c.username != "" && c.password == "" {
+			c.password = getenv("PASSWORD")
+		}
+		return
+	}
+	c.username = getenv("USERNAME")
+	c.password = getenv("PASSWORD")
+	c.token = getenv("TOKEN")
+	c.authFile = getenv("AUTHFILE")
+}
+
+func (c *credentials) keychain() authn.Keychain {
+	switch {
+	case c.token != "":
+		return staticKeychain{authn.FromConfig(authn.AuthConfig{
+			RegistryToken: c.token,
+		})}
+	case c.username != "":
+		return staticKeychain{authn.FromConfig(authn.AuthConfig{
+			Username: c.username,
+			Password: c.password,
+		})}
+	case c.authFile != "":
+		return &authFileKeychain{path: c.authFile}
+	default:
+		return authn.DefaultKeychain
+	}
+}
+
+// static returns true if the same credentials are used for all registries.
+func (c *credentials) static() bool {
+	return c.token != "" || c.username != ""
+}
+
+// checkDestinationCredentials returns an error if static credentials (a
+// username or a token) would be sent to the registries of more than one
+// destination, so that they do not leak to another registry.
+func checkDestinationCredentials(refs []*reference, ro *registryOptions, creds *credentials) error {
+	if !creds.static() {
+		return nil
+	}
+	registries := []string{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if ref.transport != transportRegistry {
+			continue
+		}
+		r, err := ro.parseReference(ref.location)
+		if err != nil {
+			return err
+		}
+		registry := r.Context().RegistryStr()
+		if !seen[registry] {
+			seen[registry] = true
+			registries = append(registries, registry)
+		}
+	}
+	if len(registries) > 1 {
+		return fmt.Errorf("destination credentials can only be used with a single registry, got %s: use -dst-authfile instead", strings.Join(registries, ", "))
+	}
+	return nil
+}
+
+// staticKeychain returns the same authenticator for all registries.
+type staticKeychain struct {
+	authn.Authenticator
+}
+
+func (s staticKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return s.Authenticator, nil
+}
+
+// authFileKeychain reads the credentials from a docker config.json at an
+// arbitrary path. The lookup follows the one of authn.DefaultKeychain.
+type authFileKeychain struct {
+	path string
+
+	once sync.Once
+	cf   *configfile.ConfigFile
+	err  error
+}
+
+func (k *authFileKeychain) load() (*configfile.ConfigFile, error) {
+	k.once.Do(func() {
+		f, err := os.Open(k.path)
+		if err != nil {
+			k.err = err
+			return
+		}
+		defer f.Close()
+		k.cf, k.err = config.LoadFromReader(f)
+		if k.err != nil {
+			k.err = fmt.Errorf("failed to load auth file '%s': %w", k.path, k.err)
+		}
+	})
+	return k.cf, k.err
+}
+
+func (k *authFileKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cf, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{
+		target.String(),
+		target.RegistryStr(),
+	} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Username == "" && cfg.Password == "" && cfg.Auth == "" && cfg.IdentityToken == "" && cfg.RegistryToken == "" {
+			continue
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}), nil
+	}
+	return authn.Anonymous, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCredentialsFromEnv(t *testing.T) {
+	t.Setenv("TEST_USERNAME", "envuser")
+	t.Setenv("TEST_PASSWORD", "envpassword")
+	t.Setenv("TEST_TOKEN", "envtoken")
+	t.Setenv("TEST_AUTHFILE", "env.json")
+
+	for _, tc := range []struct {
+		name  string
+		flags credentials
+		want  credentials
+	}{
+		{
+			"env only",
+			credentials{},
+			credentials{username: "envuser", password: "envpassword", token: "envtoken", authFile: "env.json"},
+		},
+		{
+			"creds option",
+			credentials{username: "user", password: "password"},
+			credentials{username: "user", password: "password"},
+		},
+		{
+			"username option without password",
+			credentials{username: "user"},
+			credentials{username: "user", password: "envpassword"},
+		},
+		{
+			"token option",
+			credentials{token: "token"},
+			credentials{token: "token"},
+		},
+		{
+			"authfile option",
+			credentials{authFile: "config.json"},
+			credentials{authFile: "config.json"},
+		},
+	} {
+		c := tc.flags
+		c.fromEnv("TEST")
+		if c != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, c, tc.want)
+		}
+	}
+}
+
+func TestCheckDestinationCredentials(t *testing.T) {
+	refs := func(dsts ...string) []*reference {
+		refs := []*reference{}
+		for _, dst := range dsts {
+			ref, err := parseReference(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs = append(refs, ref)
+		}
+		return refs
+	}
+	single := refs("registry.mycompany.com/alpine:3.18", "registry.mycompany.com/mirror/alpine", "oci:mirror", "docker-archive:alpine.tar")
+	multiple := refs("registry.mycompany.com/alpine", "dr.mycompany.com/alpine")
+
+	for _, tc := range []struct {
+		name  string
+		creds credentials
+		refs  []*reference
+		ok    bool
+	}{
+		{"username single registry", credentials{username: "user"}, single, true},
+		{"token single registry", credentials{token: "token"}, single, true},
+		{"username multiple registries", credentials{username: "user", password: "password"}, multiple, false},
+		{"token multiple registries", credentials{token: "token"}, multiple, false},
+		{"authfile multiple registries", credentials{authFile: "config.json"}, multiple, true},
+		{"default multiple registries", credentials{}, multiple, true},
+	} {
+		err := checkDestinationCredentials(tc.refs, &registryOptions{}, &tc.creds)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// caCert is a CA certificate which is injected into the image.
+type caCert struct {
+	// name is the name of the anchor files and the alias in java
+	// truststores. It is unique among the CAs of a run.
+	name string
+
+	cert *x509.Certificate
+}
+
+// pem returns the PEM encoded certificate.
+func (c *caCert) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: c.cert.Raw,
+	})
+}
+
+// fingerprint returns the hex encoded SHA-256 fingerprint of the certificate.
+func (c *caCert) fingerprint() string {
+	return fingerprint(c.cert)
+}
+
+// fingerprint returns the hex encoded SHA-256 fingerprint of cert.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadCAs reads the certificates of the files in paths (see
+// parseCertificates for the supported formats). A path can be a directory in
+// which case all files in it are read. Files in a directory which contain no
+// certificates are skipped. Every certificate of a bundle becomes a separate
+// CA. Certificates which are specified more than once are only returned
+// once. The password is used for JKS and PKCS12 truststores.
+func loadCAs(paths []string, password string) ([]*caCert, error) {
+	cas := []*caCert{}
+	names := map[string]bool{}
+	fingerprints := map[string]bool{}
+
+	add := func(file string, certs []*x509.Certificate) {
+		base := caName(file)
+		for i, cert := range certs {
+			name := base
+			if len(certs) > 1 {
+				name = fmt.Sprintf("%s-%d", base, i+1)
+			}
+			ca := &caCert{
+				name: uniqueName(name, names),
+				cert: cert,
+			}
+			if fingerprints[ca.fingerprint()] {
+				slog.Info("skip duplicate CA", "file", file, "subject", cert.Subject)
+				continue
+			}
+			fingerprints[ca.fingerprint()] = true
+			names[ca.name] = true
+			cas = append(cas, ca)
+		}
+	}
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			certs, err := readCertificates(p, password)
+			if err != nil {
+				return nil, err
+			}
+			if len(certs) == 0 {
+				return nil, fmt.Errorf("no certificates found in '%s' or unknown format", p)
+			}
+			add(p, certs)
+			continue
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			file := filepath.Join(p, e.Name())
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, err
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			certs, err := readCertificates(file, password)
+			if err != nil {
+				return nil, err
+			}
+			if len(certs) == 0 {
+				slog.Warn("skip file without certificates", "file", file)
+				continue
+			}
+			add(file, certs)
+		}
+	}
+
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no CA certificates found")
+	}
+	return cas, nil
+}
+
+// readCertificates reads the certificates of a file.
+func readCertificates(file, password string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificates in '%s': %w", file, err)
+	}
+	return certs, nil
+}
+
+// parseCertificates returns the certificates of data. The format is
+// detected from the content. Supported are PEM (certificates and PKCS#7),
+// DER (certificate and PKCS#7), JKS and PKCS12 truststores. Of JKS and
+// PKCS12 only the trusted certificates are returned. If the format is
+// unknown no certificates are returned.
+func parseCertificates(data []byte, password string) ([]*x509.Certificate, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return parsePEMCertificates(data)
+	}
+	if javaStoreType(data) == storeJKS {
+		return readJavaTruststore(data, password)
+	}
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		return []*x509.Certificate{cert}, nil
+	}
+	if certs, err := parsePKCS7Certificates(data); err == nil {
+		return certs, nil
+	}
+	certs, err := readJavaTruststore(data, password)
+	if errors.Is(err, pkcs12.ErrIncorrectPassword) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return certs, nil
+}
+
+// parsePEMCertificates returns the certificates of the CERTIFICATE and
+// PKCS7 blocks of data. Other blocks are ignored.
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		case "PKCS7", "CMS":
+			p7Certs, err := parsePKCS7Certificates(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, p7Certs...)
+		default:
+			slog.Warn("ignore PEM block which is not a certificate", "type", block.Type)
+		}
+	}
+	return certs, nil
+}
+
+// pemFingerprints returns the SHA-256 fingerprints of the PEM certificates in
+// data. The certificates are not parsed, so that invalid certificates of
+// existing truststores do not cause an error.
+func pemFingerprints(data []byte) map[string]bool {
+	fingerprints := map[string]bool{}
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		sum := sha256.Sum256(block.Bytes)
+		fingerprints[hex.EncodeToString(sum[:])] = true
+	}
+	return fingerprints
+}
+
+// certFingerprints returns the SHA-256 fingerprints of certs.
+func certFingerprints(certs []*x509.Certificate) map[string]bool {
+	fingerprints := map[string]bool{}
+	for _, cert := range certs {
+		fingerprints[fingerprint(cert)] = true
+	}
+	return fingerprints
+}
+
+// splitTrusted splits cas into the CAs whose fingerprint is not in present
+// and the ones which are already trusted. The already trusted CAs are
+// logged.
+func splitTrusted(cas []*caCert, present map[string]bool, file string) (missing, trusted []*caCert) {
+	for _, ca := range cas {
+		if present[ca.fingerprint()] {
+			logTrusted(file, ca)
+			trusted = append(trusted, ca)
+			continue
+		}
+		missing = append(missing, ca)
+	}
+	return missing, trusted
+}
+
+func logTrusted(file string, ca *caCert) {
+	slog.Info("CA already trusted", "file", file, "name", ca.name, "subject", ca.cert.Subject, "fingerprint", ca.fingerprint())
+}
+
+// validateCA returns an error if cert is not a CA certificate or if it is not
+// valid at the time now.
+func validateCA(cert *x509.Certificate, now time.Time) error {
+	errs := []error{}
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		errs = append(errs, errors.New("not a CA certificate (basicConstraints CA=true is missing)"))
+	}
+	if now.Before(cert.NotBefore) {
+		errs = append(errs, fmt.Errorf("not valid before %s", cert.NotBefore.Format(time.RFC3339)))
+	}
+	if now.After(cert.NotAfter) {
+		errs = append(errs, fmt.Errorf("expired at %s", cert.NotAfter.Format(time.RFC3339)))
+	}
+	return errors.Join(errs...)
+}
+
+// caWarnings returns warnings about weak keys and signature algorithms of
+// cert.
+func caWarnings(cert *x509.Certificate) []string {
+	warnings := []string{}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			warnings = append(warnings, fmt.Sprintf("weak RSA key with %d bits", key.N.BitLen()))
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize < 256 {
+			warnings = append(warnings, fmt.Sprintf("weak ECDSA key with %d bits", key.Curve.Params().BitSize))
+		}
+	case *dsa.PublicKey:
+		warnings = append(warnings, "deprecated DSA key")
+	}
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		warnings = append(warnings, fmt.Sprintf("weak signature algorithm %s", cert.SignatureAlgorithm))
+	}
+	return warnings
+}
+
+// caName returns the name of a CA from its file name without extension.
+// Since java truststores treat aliases case insensitive the name is lower
+// case. Characters which are not safe in file names are replaced with '_'.
+func caName(file string) string {
+	base := filepath.Base(file)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '_'
+	}, base)
+	if name == "" {
+		name = "ca"
+	}
+	return name
+}
+
+// uniqueName appends a number to name if it is already used.
+func uniqueName(name string, used map[string]bool) string {
+	if !used[name] {
+		return name
+	}
+	for i := 2; ; i++ {
+		n := fmt.Sprintf("%s-%d", name, i)
+		if !used[n] {
+			return n
+		}
+	}
+}
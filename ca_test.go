@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dvob/pcert"
+	"github.com/pavel-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newTestCA creates a self signed CA with the common name name.
+func newTestCA(t *testing.T, name string) *caCert {
+	t.Helper()
+	certPEM, _, err := pcert.Create(pcert.NewCACertificate(name), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := pcert.Parse(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &caCert{
+		name: name,
+		cert: cert,
+	}
+}
+
+func TestLoadCAs(t *testing.T) {
+	root := newTestCA(t, "root")
+	issuing1 := newTestCA(t, "issuing1")
+	issuing2 := newTestCA(t, "issuing2")
+	other := newTestCA(t, "other")
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "Corp Chain.pem")
+	caDir := filepath.Join(dir, "cas")
+	files := map[string][]byte{
+		bundle:                              append(append(root.pem(), issuing1.pem()...), issuing2.pem()...),
+		filepath.Join(caDir, "root.crt"):    root.pem(),
+		filepath.Join(caDir, "other.crt"):   other.pem(),
+		filepath.Join(caDir, "README"):      []byte("no certificates"),
+		filepath.Join(caDir, ".hidden.crt"): []byte("ignored"),
+	}
+	for file, data := range files {
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(file, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cas, err := loadCAs([]string{bundle, caDir}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// root.crt is a duplicate of the first certificate of the bundle
+	want := []struct {
+		name string
+		cn   string
+	}{
+		{"corp_chain-1", "root"},
+		{"corp_chain-2", "issuing1"},
+		{"corp_chain-3", "issuing2"},
+		{"other", "other"},
+	}
+	if len(cas) != len(want) {
+		t.Fatalf("got %d CAs, want %d", len(cas), len(want))
+	}
+	for i, w := range want {
+		if cas[i].name != w.name || cas[i].cert.Subject.CommonName != w.cn {
+			t.Errorf("got CA %s (%s), want %s (%s)", cas[i].name, cas[i].cert.Subject.CommonName, w.name, w.cn)
+		}
+	}
+
+	_, err = loadCAs([]string{filepath.Join(caDir, "README")}, "changeit")
+	if err == nil {
+		t.Error("expected error for a file without certificates")
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	used := map[string]bool{"ca": true, "ca-2": true}
+	if got := uniqueName("ca", used); got != "ca-3" {
+		t.Errorf("got %s, want ca-3", got)
+	}
+	if got := uniqueName("other", used); got != "other" {
+		t.Errorf("got %s, want other", got)
+	}
+}
+
+func TestValidateCA(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	valid := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+	}
+	if err := validateCA(valid, now); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	for name, modify := range map[string]func(c *x509.Certificate){
+		"leaf":          func(c *x509.Certificate) { c.IsCA = false },
+		"no constraint": func(c *x509.Certificate) { c.BasicConstraintsValid = false },
+		"expired":       func(c *x509.Certificate) { c.NotAfter = now.Add(-time.Minute) },
+		"not yet valid": func(c *x509.Certificate) { c.NotBefore = now.Add(time.Minute) },
+	} {
+		cert := *valid
+		modify(&cert)
+		if err := validateCA(&cert, now); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCAWarnings(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weak := &x509.Certificate{
+		PublicKey:          &key.PublicKey,
+		SignatureAlgorithm: x509.SHA1WithRSA,
+	}
+	if got := caWarnings(weak); len(got) != 2 {
+		t.Errorf("got warnings %v, want weak key and weak signature", got)
+	}
+
+	if got := caWarnings(newTestCA(t, "myca").cert); len(got) != 0 {
+		t.Errorf("unexpected warnings: %v", got)
+	}
+}
+
+// newTestPKCS7 returns DER encoded PKCS#7 signed data with certs.
+func newTestPKCS7(t *testing.T, certs ...*x509.Certificate) []byte {
+	t.Helper()
+	raw := []byte{}
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	emptySet := asn1.RawValue{Tag: asn1.TagSet, IsCompound: true}
+	data, err := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      asn1.RawValue{FullBytes: data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p7
+}
+
+func TestParseCertificates(t *testing.T) {
+	root := newTestCA(t, "root")
+	issuing := newTestCA(t, "issuing")
+	cas := []*caCert{root, issuing}
+
+	p7 := newTestPKCS7(t, root.cert, issuing.cert)
+
+	ks := keystore.New()
+	for _, ca := range cas {
+		err := ks.SetTrustedCertificateEntry(ca.name, keystore.TrustedCertificateEntry{
+			Certificate: keystore.Certificate{Type: "X509", Content: ca.cert.Raw},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	jks := &bytes.Buffer{}
+	err := ks.Store(jks, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p12, err := pkcs12.Modern.EncodeTrustStore([]*x509.Certificate{root.cert, issuing.cert}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordless, err := pkcs12.Passwordless.EncodeTrustStore([]*x509.Certificate{root.cert, issuing.cert}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"pem":                  append(root.pem(), issuing.pem()...),
+		"pkcs7 pem":            pem.EncodeToMemory(&pem.Block{Type: "PKCS7", Bytes: p7}),
+		"pkcs7 der":            p7,
+		"jks":                  jks.Bytes(),
+		"pkcs12":               p12,
+		"pkcs12 password-less": passwordless,
+	} {
+		certs, err := parseCertificates(data, "secret")
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(certs) != len(cas) {
+			t.Errorf("%s: got %d certificates, want %d", name, len(certs), len(cas))
+			continue
+		}
+		// the aliases of the JKS are sorted
+		if name == "jks" {
+			certs[0], certs[1] = certs[1], certs[0]
+		}
+		for i, ca := range cas {
+			if !certs[i].Equal(ca.cert) {
+				t.Errorf("%s: got %s, want %s", name, certs[i].Subject, ca.cert.Subject)
+			}
+		}
+	}
+
+	certs, err := parseCertificates(root.cert.Raw, "")
+	if err != nil || len(certs) != 1 || !certs[0].Equal(root.cert) {
+		t.Errorf("der: got %d certificates, %v", len(certs), err)
+	}
+
+	_, err = parseCertificates(jks.Bytes(), "wrong")
+	if err == nil {
+		t.Error("jks: expected error for wrong password")
+	}
+	_, err = parseCertificates(p12, "wrong")
+	if err == nil {
+		t.Error("pkcs12: expected error for wrong password")
+	}
+
+	certs, err = parseCertificates([]byte("no certificates"), "")
+	if err != nil || len(certs) != 0 {
+		t.Errorf("unknown format: got %d certificates, %v", len(certs), err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// layerCache stores the index of layers on disk, so that layers which have
+// been scanned before do not have to be downloaded and read again. The
+// layers are identified by their DiffID (the digest of the uncompressed
+// layer). The layout of the cache directory is:
+//
+//	index/sha256/HEX.json  index of the layer with the DiffID sha256:HEX
+//	blobs/sha256/HEX       captured file content with the digest sha256:HEX
+//
+// Blobs are only stored if blobs is true. Without them the captured files
+// are read from the layer on demand.
+type layerCache struct {
+	dir string
+
+	// maxSize is the size in bytes to which the cache is pruned after a
+	// run. Zero means unlimited.
+	maxSize int64
+
+	blobs bool
+}
+
+// cachedLayerIndex is the JSON representation of a layerIndex.
+type cachedLayerIndex struct {
+	Entries   []*tar.Header `json:"entries"`
+	Whiteouts []string      `json:"whiteouts,omitempty"`
+	Opaques   []string      `json:"opaques,omitempty"`
+	// Contents maps paths to the digest of their blob.
+	Contents map[string]string `json:"contents,omitempty"`
+}
+
+func (c *layerCache) indexPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "index", h.Algorithm, h.Hex+".json")
+}
+
+func (c *layerCache) blobPath(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// get returns the cached index of a layer. Blobs which are missing (e.g.
+// because they have been pruned) are not added to the index.
+func (c *layerCache) get(diffID v1.Hash) (*layerIndex, bool) {
+	p := c.indexPath(diffID)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to read cached layer index", "layer", diffID, "err", err)
+		}
+		return nil, false
+	}
+	cli := &cachedLayerIndex{}
+	err = json.Unmarshal(data, cli)
+	if err != nil {
+		slog.Warn("invalid cached layer index", "layer", diffID, "err", err)
+		return nil, false
+	}
+	touch(p)
+
+	li := &layerIndex{
+		entries:   cli.Entries,
+		whiteouts: cli.Whiteouts,
+		opaques:   cli.Opaques,
+		contents:  map[string][]byte{},
+	}
+	for path, digest := range cli.Contents {
+		h, err := v1.NewHash(digest)
+		if err != nil {
+			continue
+		}
+		bp := c.blobPath(h)
+		content, err := os.ReadFile(bp)
+		if err != nil {
+			continue
+		}
+		touch(bp)
+		li.contents[path] = content
+	}
+	// the layer is scanned again to store the blobs
+	if c.blobs && missingContent(li) {
+		slog.Debug("blobs of cached layer index missing", "layer", diffID)
+		return nil, false
+	}
+	return li, true
+}
+
+// missingContent returns true if li lacks the content of a file which is
+// captured while the layer is read (see captureFile).
+func missingContent(li *layerIndex) bool {
+	for _, hdr := range li.entries {
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxCaptureSize || !captureFile(hdr.Name) {
+			continue
+		}
+		if _, ok := li.contents[hdr.Name]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// put stores the index of a layer.
+func (c *layerCache) put(diffID v1.Hash, li *layerIndex) error {
+	cli := &cachedLayerIndex{
+		Entries:   li.entries,
+		Whiteouts: li.whiteouts,
+		Opaques:   li.opaques,
+		Contents:  map[string]string{},
+	}
+	if c.blobs {
+		for path, content := range li.contents {
+			sum := sha256.Sum256(content)
+			h := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(sum[:])}
+			err := writeFileAtomic(c.blobPath(h), content)
+			if err != nil {
+				return err
+			}
+			cli.Contents[path] = h.String()
+		}
+	}
+	data, err := json.Marshal(cli)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.indexPath(diffID), data)
+}
+
+// cacheFile is a file in the cache directory.
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// prune removes the least recently used files until the cache is not larger
+// than maxSize. It returns the number of removed bytes. Only the files
+// written by the cache are considered (see isCacheFile), other files in the
+// cache directory are left alone.
+func (c *layerCache) prune(maxSize int64) (int64, error) {
+	files := []cacheFile{}
+	var total int64
+	for dir, suffix := range map[string]string{"index": ".json", "blobs": ""} {
+		root := filepath.Join(c.dir, dir)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || !isCacheFile(root, path, suffix) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files = append(files, cacheFile{
+				path:    path,
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
+			total += info.Size()
+			return nil
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var removed int64
+	for _, f := range files {
+		if total-removed <= maxSize {
+			break
+		}
+		err := os.Remove(f.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed += f.size
+	}
+	return removed, nil
+}
+
+// isCacheFile returns true if path is an index or a blob (sha256/HEX plus
+// suffix) or a temporary file (see writeFileAtomic) below root, which is the
+// index or the blobs directory.
+func isCacheFile(root, path, suffix string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	algorithm, name, ok := strings.Cut(rel, string(filepath.Separator))
+	if !ok || algorithm != "sha256" || strings.ContainsRune(name, filepath.Separator) {
+		return false
+	}
+	if strings.HasPrefix(name, ".tmp-") {
+		return true
+	}
+	digest, ok := strings.CutSuffix(name, suffix)
+	if !ok {
+		return false
+	}
+	_, err = v1.NewHash(algorithm + ":" + digest)
+	return err == nil
+}
+
+// touch updates the modification time which is used to prune the least
+// recently used files.
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// writeFileAtomic writes the file via a temporary file, so that concurrent
+// runs never see partially written files.
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// parseSize parses a size in bytes with an optional binary suffix (K, M, G
+// or T), e.g. 512M.
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	s = strings.TrimSuffix(s, "I")
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return n * multiplier, nil
+}
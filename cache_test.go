@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestLayerCache(t *testing.T) {
+	cache := &layerCache{
+		dir:   t.TempDir(),
+		blobs: true,
+	}
+	diffID := v1.Hash{Algorithm: "sha256", Hex: "48d9183eb12a05c99bcc0bf44a003607b8e941e1d4f41f9ad12bdcc4b5672f86"}
+
+	_, ok := cache.get(diffID)
+	if ok {
+		t.Fatal("unexpected cache hit")
+	}
+
+	li := &layerIndex{
+		entries: []*tar.Header{
+			{Name: "etc/ssl/certs/ca-certificates.crt", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+		},
+		whiteouts: []string{"etc/ssl/cert.pem"},
+		opaques:   []string{"usr/local/share/ca-certificates"},
+		contents: map[string][]byte{
+			"etc/ssl/certs/ca-certificates.crt": []byte("test"),
+		},
+	}
+	err := cache.put(diffID, li)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := cache.get(diffID)
+	if !ok {
+		t.Fatal("cache miss")
+	}
+	if !reflect.DeepEqual(got.whiteouts, li.whiteouts) || !reflect.DeepEqual(got.opaques, li.opaques) || !reflect.DeepEqual(got.contents, li.contents) {
+		t.Errorf("got %+v, want %+v", got, li)
+	}
+	if len(got.entries) != 1 || got.entries[0].Name != li.entries[0].Name || got.entries[0].Mode != 0644 {
+		t.Errorf("got entries %+v, want %+v", got.entries, li.entries)
+	}
+
+	// the index has been used more recently than the blob
+	old := time.Now().Add(-time.Hour)
+	blob := filepath.Join(cache.dir, "blobs", "sha256", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
+	err = os.Chtimes(blob, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(cache.indexPath(diffID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := cache.prune(info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 4 {
+		t.Errorf("removed %d bytes, want 4", removed)
+	}
+
+	// the layer has to be scanned again to store the pruned blob
+	_, ok = cache.get(diffID)
+	if ok {
+		t.Fatal("cache hit without pruned blob")
+	}
+
+	cache.blobs = false
+	got, ok = cache.get(diffID)
+	if !ok {
+		t.Fatal("cache miss after prune")
+	}
+	if len(got.contents) != 0 {
+		t.Errorf("pruned blob still in index: %v", got.contents)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0":    0,
+		"100":  100,
+		"512K": 512 << 10,
+		"10M":  10 << 20,
+		"2GiB": 2 << 30,
+		"1t":   1 << 40,
+	} {
+		got, err := parseSize(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %d, want %d", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "10X"} {
+		_, err := parseSize(s)
+		if err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestLayerCachePruneForeignFiles(t *testing.T) {
+	cache := &layerCache{
+		dir: t.TempDir(),
+	}
+	diffID := v1.Hash{Algorithm: "sha256", Hex: "48d9183eb12a05c99bcc0bf44a003607b8e941e1d4f41f9ad12bdcc4b5672f86"}
+	err := cache.put(diffID, &layerIndex{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foreign := []string{
+		"notes.txt",
+		filepath.Join("index", "README"),
+		filepath.Join("index", "sha256", "notes.json"),
+		filepath.Join("blobs", "sha256", "sub", "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"),
+	}
+	tmp := filepath.Join("blobs", "sha256", ".tmp-123")
+	for _, f := range append(foreign, tmp) {
+		p := filepath.Join(cache.dir, f)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(p, []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = cache.prune(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{cache.indexPath(diffID), filepath.Join(cache.dir, tmp)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s not pruned", p)
+		}
+	}
+	for _, f := range foreign {
+		if _, err := os.Stat(filepath.Join(cache.dir, f)); err != nil {
+			t.Errorf("%s: %s", f, err)
+		}
+	}
+}
+
+func TestLayerCacheMissingBlobs(t *testing.T) {
+	cache := &layerCache{
+		dir: t.TempDir(),
+	}
+	diffID := v1.Hash{Algorithm: "sha256", Hex: "48d9183eb12a05c99bcc0bf44a003607b8e941e1d4f41f9ad12bdcc4b5672f86"}
+	li := &layerIndex{
+		entries: []*tar.Header{
+			{Name: "etc/ssl/certs/ca-certificates.crt", Typeflag: tar.TypeReg, Size: 4},
+		},
+		contents: map[string][]byte{
+			"etc/ssl/certs/ca-certificates.crt": []byte("test"),
+		},
+	}
+	err := cache.put(diffID, li)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get(diffID); !ok {
+		t.Fatal("cache miss without blobs")
+	}
+
+	// the index has been cached without blobs
+	cache.blobs = true
+	if _, ok := cache.get(diffID); ok {
+		t.Fatal("cache hit without the blobs")
+	}
+	err = cache.put(diffID, li)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := cache.get(diffID)
+	if !ok {
+		t.Fatal("cache miss with blobs")
+	}
+	if !reflect.DeepEqual(got.contents, li.contents) {
+		t.Errorf("got contents %v, want %v", got.contents, li.contents)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	// https://github.com/opencontainers/image-spec/blob/main/annotations.md
+	baseDigestAnnotation = "org.opencontainers.image.base.digest"
+	baseNameAnnotation   = "org.opencontainers.image.base.name"
+
+	// caFingerprintsAnnotation holds the comma separated SHA-256
+	// fingerprints of the injected CAs. It is used as label as well.
+	caFingerprintsAnnotation = "io.github.dvob.image-ca-injector.ca.fingerprints"
+
+	// caSubjectsLabel holds the subjects of the injected CAs separated by
+	// "; ".
+	caSubjectsLabel = "io.github.dvob.image-ca-injector.ca.subjects"
+
+	// caRemovedAnnotation holds the comma separated SHA-256 fingerprints
+	// and caRemovedSubjectsAnnotation the subjects separated by "; " of
+	// the CAs selected for removal (see -remove). They are used as labels
+	// as well.
+	caRemovedAnnotation         = "io.github.dvob.image-ca-injector.ca.removed.fingerprints"
+	caRemovedSubjectsAnnotation = "io.github.dvob.image-ca-injector.ca.removed.subjects"
+
+	// platformsAnnotation holds the platforms selected with -platform and
+	// compressionAnnotation the compression of the added layer (see
+	// layerFormat.String). Destinations written with other options are not
+	// up to date.
+	platformsAnnotation   = "io.github.dvob.image-ca-injector.platforms"
+	compressionAnnotation = "io.github.dvob.image-ca-injector.compression"
+
+	// versionLabel holds the version of the injector.
+	versionLabel = "io.github.dvob.image-ca-injector.version"
+)
+
+// caFingerprints returns the sorted SHA-256 fingerprints of the CAs.
+func caFingerprints(cas []*caCert) []string {
+	fingerprints := []string{}
+	for _, ca := range cas {
+		fingerprints = append(fingerprints, ca.fingerprint())
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// caSubjects returns the subjects of the CAs.
+func caSubjects(cas []*caCert) []string {
+	subjects := []string{}
+	for _, ca := range cas {
+		subjects = append(subjects, ca.cert.Subject.String())
+	}
+	return subjects
+}
+
+// manifestInfo returns the digest and the annotations of the manifest at a
+// destination. If the destination does not exist or its annotations can not
+// be read (docker-daemon and docker-archive) os.ErrNotExist is returned.
+func manifestInfo(ref *reference, ro *registryOptions, creds *credentials) (v1.Hash, map[string]string, error) {
+	var (
+		digest      v1.Hash
+		rawManifest []byte
+	)
+
+	switch ref.transport {
+	case transportRegistry:
+		r, err := ro.parseReference(ref.location)
+		if err != nil {
+			return digest, nil, err
+		}
+		options, err := makeOptions(ro, creds, r)
+		if err != nil {
+			return digest, nil, err
+		}
+		desc, err := remote.Get(r, options...)
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return digest, nil, os.ErrNotExist
+		}
+		if err != nil {
+			return digest, nil, err
+		}
+		digest = desc.Digest
+		rawManifest = desc.Manifest
+
+	case transportOCI:
+		p, err := layout.FromPath(ref.location)
+		if err != nil {
+			return digest, nil, err
+		}
+		index, err := p.ImageIndex()
+		if err != nil {
+			return digest, nil, err
+		}
+		desc, err := findLayoutDescriptor(index, ref.tag)
+		if err != nil {
+			return digest, nil, os.ErrNotExist
+		}
+		digest = desc.Digest
+		rawManifest, err = p.Bytes(desc.Digest)
+		if err != nil {
+			return digest, nil, err
+		}
+
+	default:
+		return digest, nil, os.ErrNotExist
+	}
+
+	manifest := struct {
+		Annotations map[string]string `json:"annotations"`
+	}{}
+	err := json.Unmarshal(rawManifest, &manifest)
+	if err != nil {
+		return digest, nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	return digest, manifest.Annotations, nil
+}
+
+// upToDate returns true and the digest of the destination if the
+// destination has been created from the source with the digest srcDigest
+// and has the given annotations (e.g. caFingerprintsAnnotation or
+// platformsAnnotation). An empty value matches a missing annotation.
+func upToDate(ref *reference, ro *registryOptions, creds *credentials, srcDigest v1.Hash, want map[string]string) (bool, v1.Hash) {
+	digest, annotations, err := manifestInfo(ref, ro, creds)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, digest
+	}
+	if err != nil {
+		slog.Warn("failed to check destination", "dst", ref, "err", err)
+		return false, digest
+	}
+
+	if annotations[baseDigestAnnotation] != srcDigest.String() {
+		return false, digest
+	}
+	for k, v := range want {
+		if annotations[k] != v {
+			return false, digest
+		}
+	}
+	return true, digest
+}
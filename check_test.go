@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestUpToDate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror")
+
+	src, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDigest, err := src.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	platforms, err := parsePlatforms("linux/arm64,linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations := map[string]string{
+		caFingerprintsAnnotation: "48d9183eb12a05c99bcc0bf44a003607b8e941e1d4f41f9ad12bdcc4b5672f86",
+		platformsAnnotation:      formatPlatforms(platforms),
+		compressionAnnotation:    (&layerFormat{}).String(),
+		caRemovedAnnotation:      "",
+	}
+	img := annotate(src, src, "", annotations).(v1.Image)
+	err = putLayoutImage(path, "patched", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := &reference{transport: transportOCI, location: path, tag: "patched"}
+	gotDigest, got, err := manifestInfo(ref, &registryOptions{}, &credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotDigest != digest {
+		t.Errorf("got digest %s, want %s", gotDigest, digest)
+	}
+	if got[platformsAnnotation] != "linux/amd64,linux/arm64" {
+		t.Errorf("got platforms annotation '%s'", got[platformsAnnotation])
+	}
+
+	ok, gotDigest := upToDate(ref, &registryOptions{}, &credentials{}, srcDigest, annotations)
+	if !ok || gotDigest != digest {
+		t.Errorf("got %t, %s, want up to date with %s", ok, gotDigest, digest)
+	}
+
+	other, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := upToDate(ref, &registryOptions{}, &credentials{}, otherDigest, annotations); ok {
+		t.Error("up to date with other source")
+	}
+
+	for k, v := range map[string]string{
+		caFingerprintsAnnotation: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		platformsAnnotation:      "",
+		compressionAnnotation:    (&layerFormat{compression: compressionZstd}).String(),
+	} {
+		changed := map[string]string{}
+		for k, v := range annotations {
+			changed[k] = v
+		}
+		changed[k] = v
+		if ok, _ := upToDate(ref, &registryOptions{}, &credentials{}, srcDigest, changed); ok {
+			t.Errorf("up to date with %s=%s", k, v)
+		}
+	}
+
+	for _, ref := range []*reference{
+		{transport: transportOCI, location: path, tag: "missing"},
+		{transport: transportOCI, location: filepath.Join(path, "missing")},
+		{transport: transportArchive, location: filepath.Join(path, "image.tar")},
+	} {
+		if ok, _ := upToDate(ref, &registryOptions{}, &credentials{}, srcDigest, annotations); ok {
+			t.Errorf("%s: up to date", ref)
+		}
+	}
+}
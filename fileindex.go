@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Whiteout files as described in the OCI image spec.
+// https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// cleanPath normalizes the path of a tar entry. The result is relative to the
+// root of the image (e.g. ./etc/ssl/ becomes etc/ssl). The root itself is
+// the empty string.
+func cleanPath(p string) string {
+	p = path.Clean("/" + p)
+	return strings.TrimPrefix(p, "/")
+}
+
+// layerIndex contains the entries of a single layer.
+type layerIndex struct {
+	// entries are the headers of the layer with cleaned names (see
+	// cleanPath). Whiteout files are not included.
+	entries []*tar.Header
+
+	// whiteouts are paths which the layer removes from the lower layers.
+	whiteouts []string
+
+	// opaques are directories which hide the content of the lower layers.
+	opaques []string
+
+	// contents are the captured contents of regular files.
+	contents map[string][]byte
+}
+
+// maxCaptureSize is the maximum size of a file whose content is captured
+// while reading a layer.
+const maxCaptureSize = 16 << 20
+
+// readLayerIndex reads the entries of an uncompressed layer. The content of
+// the regular files for which capture returns true is stored in the index.
+func readLayerIndex(r io.Reader, capture func(path string) bool) (*layerIndex, error) {
+	li := &layerIndex{
+		contents: map[string][]byte{},
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !li.add(hdr) || hdr.Typeflag != tar.TypeReg || hdr.Size > maxCaptureSize {
+			continue
+		}
+		name := cleanPath(hdr.Name)
+		if capture == nil || !capture(name) {
+			continue
+		}
+		li.contents[name], err = io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return li, nil
+}
+
+// add adds an entry to the layer index and returns false if the entry is a
+// whiteout.
+func (li *layerIndex) add(hdr *tar.Header) bool {
+	name := cleanPath(hdr.Name)
+	dir, base := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+
+	if base == whiteoutOpaque {
+		li.opaques = append(li.opaques, dir)
+		return false
+	}
+	if strings.HasPrefix(base, whiteoutPrefix) {
+		li.whiteouts = append(li.whiteouts, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		return false
+	}
+
+	newHdr := *hdr
+	newHdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		newHdr.Linkname = cleanPath(hdr.Linkname)
+	}
+	li.entries = append(li.entries, &newHdr)
+	return true
+}
+
+// fileEntry is a file of the image.
+type fileEntry struct {
+	hdr *tar.Header
+
+	// content is the content of the file if it has been captured while
+	// reading the layer.
+	content []byte
+
+	// layer is the index of the layer which provides the file.
+	layer int
+}
+
+// fileIndex is the view on the file system of an image after all layers
+// have been applied according to the overlay semantics of the OCI image
+// spec.
+type fileIndex struct {
+	files map[string]*fileEntry
+
+	// children are the paths in each directory. They are computed on the
+	// first readDir.
+	children map[string][]string
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{
+		files: map[string]*fileEntry{},
+	}
+}
+
+// apply applies the layer li with the index layer on top of the current
+// index. Whiteouts and opaque directories of a layer only hide the files of
+// the lower layers, not the ones of the layer itself.
+func (fi *fileIndex) apply(layer int, li *layerIndex) {
+	fi.children = nil
+
+	// the directories whose content is removed are collected first, so that
+	// the index is walked at most once per layer
+	dirs := map[string]bool{}
+	for _, dir := range li.opaques {
+		dirs[dir] = true
+	}
+	for _, p := range li.whiteouts {
+		if fi.isDir(p) {
+			dirs[p] = true
+		}
+		delete(fi.files, p)
+	}
+	for _, hdr := range li.entries {
+		// a non directory replaces a directory including its content. The
+		// directory does not need an entry of its own in the lower layers.
+		if hdr.Typeflag != tar.TypeDir && fi.isDir(hdr.Name) {
+			dirs[hdr.Name] = true
+		}
+	}
+	fi.removeContent(dirs)
+
+	for _, hdr := range li.entries {
+		fi.addParents(layer, hdr.Name)
+		fi.files[hdr.Name] = &fileEntry{
+			hdr:     hdr,
+			content: li.contents[hdr.Name],
+			layer:   layer,
+		}
+	}
+}
+
+// isDir returns true if p is a directory in the index. Symlinks are not
+// followed.
+func (fi *fileIndex) isDir(p string) bool {
+	e, ok := fi.files[p]
+	return ok && e.hdr.Typeflag == tar.TypeDir
+}
+
+// addParents adds the parent directories of p which are not in the index.
+// Layers do not need to contain entries for all directories.
+func (fi *fileIndex) addParents(layer int, p string) {
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := fi.files[dir]; ok {
+			return
+		}
+		fi.files[dir] = &fileEntry{
+			hdr: &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir,
+				Mode:     0755,
+			},
+			layer: layer,
+		}
+	}
+}
+
+// removeContent removes the content of the directories dirs. The empty
+// string is the root directory.
+func (fi *fileIndex) removeContent(dirs map[string]bool) {
+	if len(dirs) == 0 {
+		return
+	}
+	for p := range fi.files {
+		for dir := path.Dir(p); ; dir = path.Dir(dir) {
+			if dir == "." {
+				dir = ""
+			}
+			if dirs[dir] {
+				delete(fi.files, p)
+				break
+			}
+			if dir == "" {
+				break
+			}
+		}
+	}
+}
+
+func (fi *fileIndex) get(p string) (*fileEntry, bool) {
+	e, ok := fi.files[cleanPath(p)]
+	return e, ok
+}
+
+// paths returns all paths of the index sorted.
+func (fi *fileIndex) paths() []string {
+	paths := make([]string, 0, len(fi.files))
+	for p := range fi.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// maxSymlinks is the maximum number of symlinks which are followed while a
+// path is resolved.
+const maxSymlinks = 255
+
+var (
+	errSymlinkLoop = errors.New("too many levels of symbolic links")
+	errNotDir      = errors.New("not a directory")
+	errIsDir       = errors.New("is a directory")
+)
+
+// rootEntry is the root directory which has no entry in the index.
+var rootEntry = &fileEntry{
+	hdr: &tar.Header{
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	},
+}
+
+// resolve resolves the symlinks in p component by component like the kernel
+// would do it inside a container. ".." never leaves the root. The last
+// component is only followed if it is a symlink and follow is true.
+// Hardlinks are resolved to the file they link to. It returns the resolved
+// path and its entry.
+func (fi *fileIndex) resolve(p string, follow bool) (string, *fileEntry, error) {
+	rest := strings.Split(p, "/")
+	resolved := ""
+	links := 0
+	for len(rest) > 0 {
+		comp := rest[0]
+		rest = rest[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			resolved = cleanPath(path.Dir(resolved))
+			continue
+		}
+
+		next := path.Join(resolved, comp)
+		e, ok := fi.files[next]
+		if !ok {
+			return "", nil, &fs.PathError{Op: "resolve", Path: p, Err: fs.ErrNotExist}
+		}
+
+		last := len(rest) == 0
+		if e.hdr.Typeflag == tar.TypeSymlink && (!last || follow) {
+			links++
+			if links > maxSymlinks {
+				return "", nil, &fs.PathError{Op: "resolve", Path: p, Err: errSymlinkLoop}
+			}
+			if path.IsAbs(e.hdr.Linkname) {
+				resolved = ""
+			}
+			rest = append(strings.Split(e.hdr.Linkname, "/"), rest...)
+			continue
+		}
+		if !last && e.hdr.Typeflag != tar.TypeDir {
+			return "", nil, &fs.PathError{Op: "resolve", Path: p, Err: errNotDir}
+		}
+		resolved = next
+	}
+
+	if resolved == "" {
+		return "", rootEntry, nil
+	}
+	e := fi.files[resolved]
+	if e.hdr.Typeflag != tar.TypeLink {
+		return resolved, e, nil
+	}
+	target, ok := fi.files[e.hdr.Linkname]
+	if !ok || target.hdr.Typeflag == tar.TypeLink {
+		return "", nil, &fs.PathError{Op: "resolve", Path: p, Err: fs.ErrNotExist}
+	}
+	return e.hdr.Linkname, target, nil
+}
+
+// hardlinks returns the sorted paths which are hardlinks to p.
+func (fi *fileIndex) hardlinks(p string) []string {
+	links := []string{}
+	for name, e := range fi.files {
+		if e.hdr.Typeflag == tar.TypeLink && e.hdr.Linkname == p {
+			links = append(links, name)
+		}
+	}
+	sort.Strings(links)
+	return links
+}
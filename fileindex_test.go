@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFileIndex(t *testing.T) {
+	layers := [][]*tar.Header{
+		{
+			{Name: "./etc/", Typeflag: tar.TypeDir},
+			{Name: "./etc/ssl/certs/ca-certificates.crt", Typeflag: tar.TypeReg},
+			{Name: "./etc/ssl/certs/java/cacerts", Typeflag: tar.TypeReg},
+			{Name: "./opt/java/lib/security/cacerts", Typeflag: tar.TypeReg},
+			{Name: "./usr/local/share/ca-certificates/a.crt", Typeflag: tar.TypeReg},
+		},
+		{
+			{Name: "etc/ssl/certs/java/.wh.cacerts", Typeflag: tar.TypeReg},
+			{Name: "opt/java/.wh..wh..opq", Typeflag: tar.TypeReg},
+			{Name: "opt/java/lib/security/cacerts.new", Typeflag: tar.TypeReg},
+			{Name: "usr/local/share/ca-certificates", Typeflag: tar.TypeSymlink, Linkname: "/etc/ssl/certs"},
+		},
+	}
+
+	index := newFileIndex()
+	for n, hdrs := range layers {
+		li := &layerIndex{}
+		for _, hdr := range hdrs {
+			li.add(hdr)
+		}
+		index.apply(n, li)
+	}
+
+	want := []string{
+		"etc",
+		"etc/ssl",
+		"etc/ssl/certs",
+		"etc/ssl/certs/ca-certificates.crt",
+		"etc/ssl/certs/java",
+		"opt",
+		"opt/java",
+		"opt/java/lib",
+		"opt/java/lib/security",
+		"opt/java/lib/security/cacerts.new",
+		"usr",
+		"usr/local",
+		"usr/local/share",
+		"usr/local/share/ca-certificates",
+	}
+	if got := index.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for p, layer := range map[string]int{
+		"/etc/ssl/certs/ca-certificates.crt":  0,
+		"./opt/java/lib/security/cacerts.new": 1,
+	} {
+		e, ok := index.get(p)
+		if !ok {
+			t.Errorf("%s: not found", p)
+			continue
+		}
+		if e.layer != layer {
+			t.Errorf("%s: got layer %d, want %d", p, e.layer, layer)
+		}
+	}
+}
+
+func TestFileIndexResolve(t *testing.T) {
+	li := &layerIndex{}
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/pki/tls/certs/ca-bundle.crt", Typeflag: tar.TypeReg},
+		{Name: "etc/ssl/certs", Typeflag: tar.TypeSymlink, Linkname: "/etc/pki/tls/certs"},
+		{Name: "etc/ssl/cert.pem", Typeflag: tar.TypeSymlink, Linkname: "certs/ca-bundle.crt"},
+		{Name: "usr/lib/jvm/java-17/lib/security/cacerts", Typeflag: tar.TypeLink, Linkname: "etc/pki/java/cacerts"},
+		{Name: "etc/pki/java/cacerts", Typeflag: tar.TypeReg},
+		{Name: "usr/lib/jvm/default", Typeflag: tar.TypeSymlink, Linkname: "java-17"},
+		{Name: "loop/a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+		{Name: "loop/b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../../../../etc/ssl/cert.pem"},
+	} {
+		li.add(hdr)
+	}
+	index := newFileIndex()
+	index.apply(0, li)
+
+	for p, want := range map[string]string{
+		"/etc/ssl/certs/ca-bundle.crt":             "etc/pki/tls/certs/ca-bundle.crt",
+		"etc/ssl/cert.pem":                         "etc/pki/tls/certs/ca-bundle.crt",
+		"usr/lib/jvm/default/lib/security/cacerts": "etc/pki/java/cacerts",
+		"escape":                           "etc/pki/tls/certs/ca-bundle.crt",
+		"../etc/ssl/../ssl/certs/../certs": "etc/pki/tls/certs",
+		"usr/lib/jvm/default/lib/../../default/../..": "usr/lib",
+	} {
+		got, _, err := index.resolve(p, true)
+		if err != nil {
+			t.Errorf("%s: %s", p, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got '%s', want '%s'", p, got, want)
+		}
+	}
+
+	got, e, err := index.resolve("etc/ssl/certs", false)
+	if err != nil || got != "etc/ssl/certs" || e.hdr.Typeflag != tar.TypeSymlink {
+		t.Errorf("last symlink followed: %s, %v", got, err)
+	}
+
+	for _, p := range []string{"loop/a", "etc/ssl/missing", "etc/ssl/cert.pem/x"} {
+		_, _, err := index.resolve(p, true)
+		if err == nil {
+			t.Errorf("%s: expected error", p)
+		}
+	}
+
+	links := index.hardlinks("etc/pki/java/cacerts")
+	if !reflect.DeepEqual(links, []string{"usr/lib/jvm/java-17/lib/security/cacerts"}) {
+		t.Errorf("got hardlinks %v", links)
+	}
+}
+
+func TestFileIndexLarge(t *testing.T) {
+	// every layer replaces all files of the lower layer. A walk of the whole
+	// index for each entry takes minutes with this number of files.
+	const dirs, files = 1000, 100
+	layers := []*layerIndex{}
+	for n := 0; n < 3; n++ {
+		li := &layerIndex{}
+		for d := 0; d < dirs; d++ {
+			li.add(&tar.Header{Name: fmt.Sprintf("usr/share/d%d/", d), Typeflag: tar.TypeDir})
+			for f := 0; f < files; f++ {
+				li.add(&tar.Header{Name: fmt.Sprintf("usr/share/d%d/f%d", d, f), Typeflag: tar.TypeReg})
+			}
+		}
+		layers = append(layers, li)
+	}
+	last := &layerIndex{}
+	layers = append(layers, last)
+	last.add(&tar.Header{Name: "usr/share/d0/.wh..wh..opq", Typeflag: tar.TypeReg})
+	last.add(&tar.Header{Name: "usr/share/.wh.d1", Typeflag: tar.TypeReg})
+	last.add(&tar.Header{Name: "usr/share/d2", Typeflag: tar.TypeSymlink, Linkname: "d3"})
+
+	index := newFileIndex()
+	for n, li := range layers {
+		index.apply(n, li)
+	}
+
+	// usr, usr/share, the directories and files without the removed d1,
+	// the content of the opaque d0 and the content of d2 which has been
+	// replaced by a symlink
+	want := 2 + dirs*(files+1) - (files + 1) - 2*files
+	if got := len(index.files); got != want {
+		t.Errorf("got %d files, want %d", got, want)
+	}
+	e, ok := index.get("usr/share/d4/f0")
+	if !ok || e.layer != 2 {
+		t.Errorf("usr/share/d4/f0 of layer 2 missing: %v", e)
+	}
+	if _, ok := index.get("usr/share/d0/f0"); ok {
+		t.Error("usr/share/d0/f0 in opaque directory not removed")
+	}
+}
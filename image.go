@@ -3,160 +3,475 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/compression"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
-type patchFn func(i *image) ([]v1.Layer, error)
+// Types of truststores.
+const (
+	storePEMBundle = "pem-bundle"
+	storeAnchor    = "anchor"
+	storeJKS       = "jks"
+	storePKCS12    = "pkcs12"
+)
+
+// fileChange is a file which is created or modified by a patch.
+type fileChange struct {
+	hdr     *tar.Header
+	content []byte
+
+	// storeType is the type of the truststore (see store... constants).
+	storeType string
+
+	// created is true if the file did not exist in the image before.
+	created bool
+
+	// links are the paths of the hardlinks to the file. They are written
+	// to the same layer, so that they keep pointing to the new content.
+	links []string
+
+	// trusted are the CAs which the truststore already contained.
+	trusted []*caCert
+
+	// unchanged is true if the truststore already contained all CAs. The
+	// file is only reported and not written.
+	unchanged bool
+
+	// removed are the CAs which have been removed from the truststore.
+	removed []*caCert
+
+	// deleted is true if the file is removed with a whiteout.
+	deleted bool
+}
+
+// patchFn returns the changes which add the CA to the truststores in fsys.
+type patchFn func(fsys fs.FS) ([]*fileChange, error)
+
+// Compression of the added layers.
+const (
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionNone = "none"
+)
+
+// layerFormat describes the format of the added layers.
+type layerFormat struct {
+	// compression is one of the compression... constants. Layers are gzip
+	// compressed if it is empty.
+	compression string
+
+	// level is the compression level. The default level is used if it is
+	// zero.
+	level int
+}
+
+// String returns the compression and the level if it is set (e.g. gzip or
+// zstd:19).
+func (lf *layerFormat) String() string {
+	compression := lf.compression
+	if compression == "" {
+		compression = compressionGzip
+	}
+	if lf.level == 0 {
+		return compression
+	}
+	return fmt.Sprintf("%s:%d", compression, lf.level)
+}
+
+// mediaType returns the media type of a layer in an image with the manifest
+// media type manifest. The layers are OCI layers for OCI manifests and
+// Docker layers otherwise. Docker manifests do not support zstd.
+func (lf *layerFormat) mediaType(manifest types.MediaType) (types.MediaType, error) {
+	oci := manifest == types.OCIManifestSchema1
+	switch lf.compression {
+	case compressionGzip, "":
+		if oci {
+			return types.OCILayer, nil
+		}
+		return types.DockerLayer, nil
+	case compressionZstd:
+		if oci {
+			return types.OCILayerZStd, nil
+		}
+		return "", fmt.Errorf("zstd compression is not supported for images with the manifest type %s", manifest)
+	case compressionNone:
+		if oci {
+			return types.OCIUncompressedLayer, nil
+		}
+		return types.DockerUncompressedLayer, nil
+	default:
+		return "", fmt.Errorf("unknown compression '%s'. want %s, %s or %s", lf.compression, compressionGzip, compressionZstd, compressionNone)
+	}
+}
+
+// layer returns a layer with the uncompressed tar archive content.
+func (lf *layerFormat) layer(content []byte, mediaType types.MediaType) (v1.Layer, error) {
+	if lf.compression == compressionNone {
+		return static.NewLayer(content, mediaType), nil
+	}
+
+	opts := []tarball.LayerOption{
+		tarball.WithMediaType(mediaType),
+		tarball.WithCompressedCaching,
+	}
+	if lf.compression == compressionZstd {
+		opts = append(opts, tarball.WithCompression(compression.ZStd))
+	}
+	if lf.level != 0 {
+		opts = append(opts, tarball.WithCompressionLevel(lf.level))
+	}
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}, opts...)
+}
+
+// newLayer returns a layer with the changes. The entries are sorted by path
+// and the layer contains the parent directories of the changed files. The
+// headers of existing directories are taken from fsys, missing directories
+// are created. If several changes have the same path, the last one is used.
+// If readable is true, the files and directories are made readable for all
+// users (e.g. for images which run as non-root user).
+func newLayer(fsys fs.FS, changes []*fileChange, mediaType types.MediaType, lf *layerFormat, readable bool) (v1.Layer, error) {
+	files := map[string]*fileChange{}
+	for _, change := range changes {
+		files[change.hdr.Name] = change
+	}
+
+	hdrs := map[string]*tar.Header{}
+	links := []*tar.Header{}
+	for name, change := range files {
+		if change.deleted {
+			for _, p := range append([]string{name}, change.links...) {
+				wh := whiteoutHeader(p, change.hdr.ModTime)
+				hdrs[wh.Name] = wh
+				err := addParentDirs(fsys, hdrs, p, change.hdr.ModTime)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
 
-func chainPatchFns(patches ...patchFn) patchFn {
-	return func(i *image) ([]v1.Layer, error) {
-		layers := []v1.Layer{}
-		for _, patch := range patches {
-			changes, err := patch(i)
+		hdr := *change.hdr
+		hdr.Size = int64(len(change.content))
+		if readable {
+			makeReadable(&hdr)
+		}
+		hdrs[name] = &hdr
+		err := addParentDirs(fsys, hdrs, name, hdr.ModTime)
+		if err != nil {
+			return nil, err
+		}
+
+		// hardlinks must follow their target
+		for _, link := range change.links {
+			linkHdr := hdr
+			linkHdr.Typeflag = tar.TypeLink
+			linkHdr.Name = link
+			linkHdr.Linkname = name
+			linkHdr.Size = 0
+			links = append(links, &linkHdr)
+			err := addParentDirs(fsys, hdrs, link, hdr.ModTime)
 			if err != nil {
 				return nil, err
 			}
-			layers = append(layers, changes...)
 		}
-		return layers, nil
 	}
-}
 
-func newLayer(hdr *tar.Header, modTime time.Time, content []byte) (v1.Layer, error) {
+	names := make([]string, 0, len(hdrs))
+	for name := range hdrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Name < links[j].Name
+	})
+
+	if readable {
+		for _, name := range names {
+			makeReadable(hdrs[name])
+		}
+	}
+
 	var buf bytes.Buffer
 	tw := tar.NewWriter(&buf)
-	newHdr := *hdr
-	newHdr.Size = int64(len(content))
-	newHdr.ModTime = modTime
+	for _, name := range names {
+		hdr := cleanHeader(hdrs[name])
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return nil, err
+		}
+		change, ok := files[name]
+		if !ok {
+			continue
+		}
+		n, err := tw.Write(change.content)
+		if err != nil {
+			return nil, err
+		}
+		if int64(n) != hdr.Size {
+			return nil, fmt.Errorf("failed to write content into layer")
+		}
+	}
+	for _, hdr := range links {
+		err := tw.WriteHeader(cleanHeader(hdr))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	err := tw.WriteHeader(&newHdr)
+	err := tw.Close()
 	if err != nil {
 		return nil, err
 	}
+	return lf.layer(buf.Bytes(), mediaType)
+}
 
-	n, err := tw.Write(content)
-	if err != nil {
-		return nil, err
+// whiteoutHeader returns the header of the whiteout file which removes p.
+func whiteoutHeader(p string, modTime time.Time) *tar.Header {
+	dir, base := path.Split(p)
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(dir, whiteoutPrefix+base),
+		Mode:     0644,
+		ModTime:  modTime,
 	}
-	if int64(n) != newHdr.Size {
-		return nil, fmt.Errorf("failed to write content into layer")
+}
+
+// securityXattrPrefix is the prefix of the PAX records of security xattrs
+// (e.g. SELinux labels).
+const securityXattrPrefix = "SCHILY.xattr.security."
+
+// cleanHeader returns a copy of hdr for a new layer. From the PAX records
+// only the security xattrs are kept. Access and change times are removed.
+func cleanHeader(hdr *tar.Header) *tar.Header {
+	newHdr := *hdr
+	newHdr.PAXRecords = securityXattrs(hdr.PAXRecords)
+	newHdr.Xattrs = nil // deprecated, the xattrs are in PAXRecords
+	newHdr.AccessTime = time.Time{}
+	newHdr.ChangeTime = time.Time{}
+	newHdr.Format = tar.FormatUnknown
+	return &newHdr
+}
+
+// securityXattrs returns the security xattrs of PAX records or nil if there
+// are none.
+func securityXattrs(records map[string]string) map[string]string {
+	var xattrs map[string]string
+	for k, v := range records {
+		if !strings.HasPrefix(k, securityXattrPrefix) {
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string]string{}
+		}
+		xattrs[k] = v
 	}
+	return xattrs
+}
 
-	err = tw.Close()
-	if err != nil {
-		return nil, err
+// makeReadable adds read permissions for all users to a file and read and
+// execute permissions to a directory.
+func makeReadable(hdr *tar.Header) {
+	perm := int64(0444)
+	if hdr.Typeflag == tar.TypeDir {
+		perm = 0555
+	}
+	if hdr.Mode&perm == perm {
+		return
 	}
-	return static.NewLayer(buf.Bytes(), types.DockerLayer), nil
+	slog.Info("make readable for all users", "file", hdr.Name, "mode", fmt.Sprintf("%o", hdr.Mode), "new_mode", fmt.Sprintf("%o", hdr.Mode|perm))
+	hdr.Mode |= perm
 }
 
-type image struct {
-	tmpFile      *os.File
-	tmpImage     v1.Image
-	fileMetaData map[string]*tar.Header
+// newFileHeader returns the header of a new regular file at p. The owner,
+// mode and security xattrs are taken from a regular file in the same
+// directory. If there is none, the owner and xattrs of the directory and
+// the mode 0644 are used. Files in missing directories are owned by root.
+func newFileHeader(fsys fs.FS, p string, modTime time.Time) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     p,
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+
+	var ref *tar.Header
+	dir := path.Dir(p)
+	entries, _ := fs.ReadDir(fsys, dir)
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		sibling, err := fileHeader(fsys, path.Join(dir, e.Name()))
+		if err == nil {
+			ref = sibling
+			hdr.Mode = sibling.Mode & 0777
+			break
+		}
+	}
+	if ref == nil {
+		dirHdr, err := fileHeader(fsys, dir)
+		if err != nil {
+			return hdr
+		}
+		ref = dirHdr
+	}
+
+	hdr.Uid = ref.Uid
+	hdr.Gid = ref.Gid
+	hdr.Uname = ref.Uname
+	hdr.Gname = ref.Gname
+	hdr.PAXRecords = securityXattrs(ref.PAXRecords)
+	return hdr
 }
 
-func newImage(srcImg v1.Image) (*image, error) {
+// addParentDirs adds the headers of the parent directories of p to hdrs.
+// Directories which do not exist in fsys are owned by root and get the mode
+// 0755 and modTime. The parents must not be symlinks, since a directory
+// entry would replace the symlink (see resolveNewPath).
+func addParentDirs(fsys fs.FS, hdrs map[string]*tar.Header, p string, modTime time.Time) error {
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if _, ok := hdrs[dir]; ok {
+			return nil
+		}
+		hdr, err := lstatHeader(fsys, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			hdr = &tar.Header{
+				Typeflag: tar.TypeDir,
+				Mode:     0755,
+				ModTime:  modTime,
+			}
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			return fmt.Errorf("parent of %s is a symlink: %s", p, dir)
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("parent of %s is not a directory: %s", p, dir)
+		}
+		hdr.Name = dir
+		hdrs[dir] = hdr
+	}
+	return nil
+}
 
-	var (
-		err error
-		i   = &image{}
-	)
+// image gives access to the files of an image. The layers are read once
+// while the file index is built. The contents of the files which the
+// patchers are likely to read are captured in this pass (see captureFile).
+type image struct {
+	src    v1.Image
+	layers []v1.Layer
+	index  *fileIndex
+}
 
-	i.tmpFile, err = os.CreateTemp("", "image-ca-injector-*.tar")
+// newImage reads the file index of srcImg. If cache is not nil, the indexes
+// of the layers are read from and stored in the cache.
+func newImage(srcImg v1.Image, cache *layerCache) (*image, error) {
+	layers, err := srcImg.Layers()
 	if err != nil {
 		return nil, err
 	}
 
-	err = tarball.Write(name.MustParseReference("tmp"), srcImg, i.tmpFile)
-	if err != nil {
-		i.close()
-		return nil, err
+	index := newFileIndex()
+	for n, layer := range layers {
+		li, err := scanLayer(layer, cache)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %d: %w", n, err)
+		}
+		index.apply(n, li)
+	}
+
+	return &image{
+		src:    srcImg,
+		layers: layers,
+		index:  index,
+	}, nil
+}
+
+// scanLayer reads the layer once and returns its index.
+func scanLayer(layer v1.Layer, cache *layerCache) (*layerIndex, error) {
+	var diffID v1.Hash
+	if cache != nil {
+		var err error
+		diffID, err = layer.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		li, ok := cache.get(diffID)
+		if ok {
+			slog.Debug("layer index read from cache", "layer", diffID)
+			return li, nil
+		}
 	}
 
-	tag, err := name.NewTag("tmp")
+	rc, err := layer.Uncompressed()
 	if err != nil {
-		i.close()
 		return nil, err
 	}
-
-	i.tmpImage, err = tarball.ImageFromPath(i.tmpFile.Name(), &tag)
+	defer rc.Close()
+	li, err := readLayerIndex(rc, captureFile)
 	if err != nil {
-		i.close()
 		return nil, err
 	}
-
-	i.fileMetaData, err = readMeta(i.tmpImage)
+	// read the padding after the end of the archive, so that the digest of
+	// the layer gets verified
+	_, err = io.Copy(io.Discard, rc)
 	if err != nil {
-		i.close()
 		return nil, err
 	}
-	return i, nil
-}
 
-func (i *image) files() []string {
-	files := []string{}
-	for path := range i.fileMetaData {
-		files = append(files, path)
+	if cache != nil {
+		err = cache.put(diffID, li)
+		if err != nil {
+			slog.Warn("failed to cache layer index", "layer", diffID, "err", err)
+		}
 	}
-	return files
-}
-
-func (i *image) image() v1.Image {
-	return i.tmpImage
+	return li, nil
 }
 
-func (i *image) resolve(path string) (*tar.Header, bool) {
-	file, ok := i.fileMetaData[path]
-	if !ok {
-		return nil, false
+// captureFile returns true for the files whose content is captured while
+// the layers are read. Other files are read from their layer on demand.
+func captureFile(p string) bool {
+	if path.Base(p) == "cacerts" {
+		return true
 	}
-
-	if file.Linkname == "" {
-		return file, true
+	if _, ok := customCertLocations["/"+path.Dir(p)]; ok {
+		return true
 	}
-
-	if filepath.IsAbs(file.Linkname) {
-		linkPath := file.Linkname[1:]
-		return i.resolve(linkPath)
+	for _, f := range captureFiles {
+		if p == f[1:] {
+			return true
+		}
 	}
-
-	linkPath := filepath.Join(filepath.Dir(path), file.Linkname)
-
-	return i.resolve(linkPath)
-}
-
-func (i *image) getMeta(path string) (*tar.Header, bool) {
-	file, ok := i.fileMetaData[path]
-	return file, ok
+	return false
 }
 
-func (i *image) open(path string) (io.ReadCloser, error) {
-	file, ok := i.resolve(path)
-	if !ok {
-		return nil, fmt.Errorf("could not resolve link '%s'", path)
-	}
-	rc := mutate.Extract(i.tmpImage)
-	return newTarFileReader(file.Name, rc)
-}
+// captureFiles are the files read by the patchers and getOSInfo.
+var captureFiles = append([]string{
+	"/etc/os-release",
+	"/usr/lib/os-release",
+	"/etc/debian_version",
+	"/etc/centos-release",
+	"/etc/redhat-release",
+}, certFiles...)
 
-func (i *image) close() error {
-	err := i.tmpFile.Close()
-	if err != nil {
-		os.Remove(i.tmpFile.Name())
-		return err
-	}
-	return os.Remove(i.tmpFile.Name())
+func (i *image) image() v1.Image {
+	return i.src
 }
 
 type tarFileReader struct {
@@ -179,7 +494,7 @@ func newTarFileReader(path string, readCloser io.ReadCloser) (*tarFileReader, er
 			return nil, err
 		}
 
-		if f.Name == path {
+		if cleanPath(f.Name) == path {
 			if f.Typeflag != tar.TypeReg {
 				readCloser.Close()
 				return nil, fmt.Errorf("path %s is not a regular file", path)
@@ -206,24 +521,3 @@ func (t *tarFileReader) Close() error {
 func (t *tarFileReader) Read(p []byte) (int, error) {
 	return t.reader.Read(p)
 }
-
-func readMeta(img v1.Image) (map[string]*tar.Header, error) {
-	files := map[string]*tar.Header{}
-
-	rc := mutate.Extract(img)
-	tr := tar.NewReader(rc)
-
-	for {
-		f, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			rc.Close()
-			return nil, err
-		}
-		files[f.Name] = f
-	}
-	return files, rc.Close()
-}
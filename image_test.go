@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestNewLayer(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	// fstest.MapFS adds missing directories with the mode 0555
+	fsys := fstest.MapFS{
+		"etc/ssl/certs/java/cacerts": {Data: []byte("old"), Mode: 0600},
+		"etc":                        {Mode: fs.ModeDir | 0700},
+	}
+	changes := []*fileChange{
+		{
+			hdr: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "etc/ssl/certs/java/cacerts",
+				Mode:     0600,
+				Uid:      1000,
+				ModTime:  modTime,
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.security.selinux": "system_u:object_r:cert_t:s0",
+					"SCHILY.xattr.user.comment":     "dropped",
+					"mtime":                         "1.5",
+				},
+			},
+			content: []byte("new"),
+			links:   []string{"usr/lib/jvm/java-17/lib/security/cacerts"},
+		},
+		{
+			hdr:     newFileHeader(fsys, "usr/local/share/ca-certificates/myca.crt", modTime),
+			content: []byte("ca"),
+		},
+	}
+
+	layer, err := newLayer(fsys, changes, types.DockerLayer, &layerFormat{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, err := layer.MediaType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != types.DockerLayer {
+		t.Errorf("got media type %s", mediaType)
+	}
+
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	type entry struct {
+		name string
+		mode int64
+		uid  int
+		link string
+	}
+	got := []entry{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry{hdr.Name, hdr.Mode, hdr.Uid, hdr.Linkname})
+		if hdr.Name == "etc/ssl/certs/java/cacerts" {
+			want := map[string]string{"SCHILY.xattr.security.selinux": "system_u:object_r:cert_t:s0"}
+			if !reflect.DeepEqual(hdr.PAXRecords, want) {
+				t.Errorf("got PAX records %v, want %v", hdr.PAXRecords, want)
+			}
+		}
+	}
+
+	want := []entry{
+		{"etc", 0755, 0, ""},
+		{"etc/ssl", 0555, 0, ""},
+		{"etc/ssl/certs", 0555, 0, ""},
+		{"etc/ssl/certs/java", 0555, 0, ""},
+		{"etc/ssl/certs/java/cacerts", 0644, 1000, ""},
+		{"usr", 0755, 0, ""},
+		{"usr/lib", 0755, 0, ""},
+		{"usr/lib/jvm", 0755, 0, ""},
+		{"usr/lib/jvm/java-17", 0755, 0, ""},
+		{"usr/lib/jvm/java-17/lib", 0755, 0, ""},
+		{"usr/lib/jvm/java-17/lib/security", 0755, 0, ""},
+		{"usr/local", 0755, 0, ""},
+		{"usr/local/share", 0755, 0, ""},
+		{"usr/local/share/ca-certificates", 0755, 0, ""},
+		{"usr/local/share/ca-certificates/myca.crt", 0644, 0, ""},
+		{"usr/lib/jvm/java-17/lib/security/cacerts", 0644, 1000, "etc/ssl/certs/java/cacerts"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestNewLayerWhiteout(t *testing.T) {
+	fsys := fstest.MapFS{
+		"usr/local/share/ca-certificates/myca.crt": {Data: []byte("ca")},
+		"etc/ssl/certs/myca.pem":                   {Data: []byte("ca")},
+	}
+	changes := []*fileChange{
+		{
+			hdr:     &tar.Header{Name: "usr/local/share/ca-certificates/myca.crt"},
+			links:   []string{"etc/ssl/certs/myca.pem"},
+			deleted: true,
+		},
+	}
+	layer, err := newLayer(fsys, changes, types.DockerLayer, &layerFormat{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	whiteouts := []string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			whiteouts = append(whiteouts, hdr.Name)
+		}
+	}
+	want := []string{"etc/ssl/certs/.wh.myca.pem", "usr/local/share/ca-certificates/.wh.myca.crt"}
+	if !reflect.DeepEqual(whiteouts, want) {
+		t.Errorf("got %v, want %v", whiteouts, want)
+	}
+}
+
+func TestNewLayerSymlinkParent(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	li := &layerIndex{
+		contents: map[string][]byte{
+			"etc/os-release": []byte("ID=alpine\nVERSION_ID=3.18.4\n"),
+		},
+	}
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/os-release", Typeflag: tar.TypeReg, Size: 27, Mode: 0644},
+		{Name: "opt/local", Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000},
+		{Name: "usr/local", Typeflag: tar.TypeSymlink, Linkname: "/opt/local", Mode: 0777},
+	} {
+		li.add(hdr)
+	}
+	index := newFileIndex()
+	index.apply(0, li)
+	img := &image{
+		index: index,
+	}
+
+	changes, err := putPEMTruststore([]*caCert{newTestCA(t, "myca")}, modTime)(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].hdr.Name != "opt/local/share/ca-certificates/myca.crt" {
+		t.Fatalf("got changes %v", changes)
+	}
+
+	layer, err := newLayer(img, changes, types.DockerLayer, &layerFormat{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	type entry struct {
+		name     string
+		typeflag byte
+		uid      int
+	}
+	got := []entry{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry{hdr.Name, hdr.Typeflag, hdr.Uid})
+	}
+	want := []entry{
+		{"opt", tar.TypeDir, 0},
+		{"opt/local", tar.TypeDir, 1000},
+		{"opt/local/share", tar.TypeDir, 0},
+		{"opt/local/share/ca-certificates", tar.TypeDir, 0},
+		{"opt/local/share/ca-certificates/myca.crt", tar.TypeReg, 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+
+	// a change below a symlink would replace it with a directory
+	_, err = newLayer(img, []*fileChange{
+		{hdr: newFileHeader(img, "usr/local/share/ca-certificates/myca.crt", modTime), content: []byte("ca")},
+	}, types.DockerLayer, &layerFormat{}, false)
+	if err == nil {
+		t.Error("expected error for symlink parent")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// The image is a read only file system of the files in the image. Symlinks
+// are resolved like inside a container (see fileIndex.resolve). Besides the
+// interfaces below it provides ReadLink and Lstat.
+var (
+	_ fs.FS         = &image{}
+	_ fs.StatFS     = &image{}
+	_ fs.ReadDirFS  = &image{}
+	_ fs.ReadFileFS = &image{}
+)
+
+func (i *image) lookup(op, name string, follow bool) (string, *fileEntry, error) {
+	if !fs.ValidPath(name) {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	resolved, file, err := i.index.resolve(name, follow)
+	if err != nil {
+		return "", nil, &fs.PathError{Op: op, Path: name, Err: underlyingError(err)}
+	}
+	return resolved, file, nil
+}
+
+// underlyingError returns the error of a fs.PathError.
+func underlyingError(err error) error {
+	if perr, ok := err.(*fs.PathError); ok {
+		return perr.Err
+	}
+	return err
+}
+
+// Open opens a file. The content of regular files is read on the first
+// Read. If it has not been captured while reading the layers, it is read
+// from the layer which provides the file.
+func (i *image) Open(name string) (fs.File, error) {
+	resolved, file, err := i.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	f := &imageFile{
+		info: newFileInfo(name, file.hdr),
+	}
+	switch file.hdr.Typeflag {
+	case tar.TypeDir:
+		f.dir = i.index.readDir(resolved)
+	case tar.TypeReg:
+		f.open = func() (io.ReadCloser, error) {
+			return i.openContent(resolved, file)
+		}
+	}
+	return f, nil
+}
+
+func (i *image) openContent(resolved string, file *fileEntry) (io.ReadCloser, error) {
+	if file.content != nil {
+		return io.NopCloser(bytes.NewReader(file.content)), nil
+	}
+	rc, err := i.layers[file.layer].Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return newTarFileReader(resolved, rc)
+}
+
+// ReadFile reads the content of a file.
+func (i *image) ReadFile(name string) ([]byte, error) {
+	resolved, file, err := i.lookup("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if file.hdr.Typeflag == tar.TypeDir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	if file.hdr.Typeflag != tar.TypeReg {
+		return []byte{}, nil
+	}
+	rc, err := i.openContent(resolved, file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Stat returns the file info of a file. Symlinks are followed. Sys returns
+// the *tar.Header of the file whose name is the resolved path.
+func (i *image) Stat(name string) (fs.FileInfo, error) {
+	_, file, err := i.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(name, file.hdr), nil
+}
+
+// Lstat returns the file info of a file without following a symlink in the
+// last component.
+func (i *image) Lstat(name string) (fs.FileInfo, error) {
+	_, file, err := i.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(name, file.hdr), nil
+}
+
+// ReadLink returns the destination of a symlink.
+func (i *image) ReadLink(name string) (string, error) {
+	_, file, err := i.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if file.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return file.hdr.Linkname, nil
+}
+
+// ReadDir returns the sorted entries of a directory.
+func (i *image) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, file, err := i.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if file.hdr.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	return i.index.readDir(resolved), nil
+}
+
+// readDir returns the sorted entries of the directory dir.
+func (fi *fileIndex) readDir(dir string) []fs.DirEntry {
+	if fi.children == nil {
+		fi.children = map[string][]string{}
+		for p := range fi.files {
+			parent := cleanPath(path.Dir(p))
+			fi.children[parent] = append(fi.children[parent], p)
+		}
+		for _, c := range fi.children {
+			sort.Strings(c)
+		}
+	}
+	entries := []fs.DirEntry{}
+	for _, p := range fi.children[dir] {
+		hdr := fi.files[p].hdr
+		entries = append(entries, fs.FileInfoToDirEntry(newFileInfo(p, hdr)))
+	}
+	return entries
+}
+
+// fileInfo is the file info of a tar header with the name it has been
+// looked up with.
+type fileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func newFileInfo(name string, hdr *tar.Header) fs.FileInfo {
+	return &fileInfo{
+		FileInfo: hdr.FileInfo(),
+		name:     path.Base(name),
+	}
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+// imageFile is an opened file of the image.
+type imageFile struct {
+	info fs.FileInfo
+
+	// open opens the content of regular files
+	open func() (io.ReadCloser, error)
+	rc   io.ReadCloser
+
+	// dir are the remaining entries of a directory
+	dir []fs.DirEntry
+}
+
+var _ fs.ReadDirFile = &imageFile{}
+
+func (f *imageFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *imageFile) Read(p []byte) (int, error) {
+	if f.info.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.info.Name(), Err: errIsDir}
+	}
+	if f.open == nil {
+		return 0, io.EOF
+	}
+	if f.rc == nil {
+		rc, err := f.open()
+		if err != nil {
+			return 0, err
+		}
+		f.rc = rc
+	}
+	return f.rc.Read(p)
+}
+
+func (f *imageFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.info.Name(), Err: errNotDir}
+	}
+	if n <= 0 {
+		entries := f.dir
+		f.dir = nil
+		return entries, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dir) {
+		n = len(f.dir)
+	}
+	entries := f.dir[:n]
+	f.dir = f.dir[n:]
+	return entries, nil
+}
+
+func (f *imageFile) Close() error {
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+	return nil
+}
+
+// fileHeader returns a copy of the tar header of the file name with the
+// resolved path as name. For file systems which are not an image (e.g. in
+// tests) the header is created from the file info.
+func fileHeader(fsys fs.FS, name string) (*tar.Header, error) {
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return infoHeader(info, name)
+}
+
+// lstatHeader returns a copy of the tar header of the file name like
+// fileHeader, but a symlink in the last component is not followed. For file
+// systems without Lstat it is the same as fileHeader.
+func lstatHeader(fsys fs.FS, name string) (*tar.Header, error) {
+	lfs, ok := fsys.(interface {
+		Lstat(name string) (fs.FileInfo, error)
+	})
+	if !ok {
+		return fileHeader(fsys, name)
+	}
+	info, err := lfs.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return infoHeader(info, name)
+}
+
+func infoHeader(info fs.FileInfo, name string) (*tar.Header, error) {
+	if hdr, ok := info.Sys().(*tar.Header); ok {
+		newHdr := *hdr
+		return &newHdr, nil
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	return hdr, nil
+}
+
+// resolveNewPath returns the path at which a file name which does not exist
+// yet has to be created. The longest existing parent directory of name is
+// resolved, so that symlinks to directories are followed (e.g. usr/local ->
+// /opt/local gives opt/local/share/... for usr/local/share/...).
+func resolveNewPath(fsys fs.FS, name string) (string, error) {
+	rest := []string{}
+	for dir := name; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		hdr, err := fileHeader(fsys, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			rest = append([]string{path.Base(dir)}, rest...)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			return "", &fs.PathError{Op: "resolve", Path: name, Err: errNotDir}
+		}
+		return path.Join(append([]string{hdr.Name}, rest...)...), nil
+	}
+	return name, nil
+}
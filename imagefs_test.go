@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/tar"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestImageFS(t *testing.T) {
+	li := &layerIndex{
+		contents: map[string][]byte{
+			"etc/pki/tls/certs/ca-bundle.crt": []byte("bundle"),
+		},
+	}
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/pki/tls/certs/ca-bundle.crt", Typeflag: tar.TypeReg, Size: 6, Mode: 0644},
+		{Name: "etc/ssl/certs", Typeflag: tar.TypeSymlink, Linkname: "/etc/pki/tls/certs", Mode: 0777},
+		{Name: "etc/ssl/cert.pem", Typeflag: tar.TypeSymlink, Linkname: "certs/ca-bundle.crt", Mode: 0777},
+		{Name: "usr/local/share/ca-certificates", Typeflag: tar.TypeDir, Mode: 0755},
+	} {
+		li.add(hdr)
+	}
+	index := newFileIndex()
+	index.apply(0, li)
+	img := &image{
+		index: index,
+	}
+
+	err := fstest.TestFS(img, "etc/pki/tls/certs/ca-bundle.crt", "etc/ssl/cert.pem", "usr/local/share/ca-certificates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := fs.ReadFile(img, "etc/ssl/certs/ca-bundle.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "bundle" {
+		t.Errorf("got content '%s'", content)
+	}
+
+	hdr, err := fileHeader(img, "etc/ssl/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "etc/pki/tls/certs/ca-bundle.crt" {
+		t.Errorf("got name '%s'", hdr.Name)
+	}
+
+	target, err := img.ReadLink("etc/ssl/cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "certs/ca-bundle.crt" {
+		t.Errorf("got link '%s'", target)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// parsePlatforms parses a comma separated list of platforms (e.g.
+// linux/amd64,linux/arm64/v8).
+func parsePlatforms(list string) ([]v1.Platform, error) {
+	platforms := []v1.Platform{}
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := v1.ParsePlatform(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform '%s': %w", s, err)
+		}
+		platforms = append(platforms, *p)
+	}
+	return platforms, nil
+}
+
+// formatPlatforms returns the sorted platforms as comma separated list.
+func formatPlatforms(platforms []v1.Platform) string {
+	list := []string{}
+	for _, p := range platforms {
+		list = append(list, p.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+// matchPlatform returns true if p satisfies one of the platforms. An empty
+// list of platforms matches every platform.
+func matchPlatform(p *v1.Platform, platforms []v1.Platform) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	for _, want := range platforms {
+		if p.Satisfies(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAttestation returns true for manifests which do not describe a runnable
+// image (e.g. the attestation manifests added by buildx).
+func isAttestation(desc v1.Descriptor) bool {
+	if desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+		return true
+	}
+	return desc.Platform != nil && desc.Platform.OS == "unknown" && desc.Platform.Architecture == "unknown"
+}
+
+// patchIndex runs patch for every image in idx which matches one of the
+// platforms and returns a new index which contains the patched images.
+func patchIndex(idx v1.ImageIndex, platforms []v1.Platform, patch func(v1.Image) (v1.Image, error)) (v1.ImageIndex, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, err := idx.MediaType()
+	if err != nil {
+		return nil, err
+	}
+
+	newIdx := mutate.IndexMediaType(empty.Index, mediaType)
+	adds := []mutate.IndexAddendum{}
+	// an image can be referenced multiple times (e.g. with different tags)
+	patched := map[v1.Hash]v1.Image{}
+	for _, desc := range manifest.Manifests {
+		if !desc.MediaType.IsImage() {
+			slog.Warn("skip manifest which is not an image", "digest", desc.Digest, "media_type", desc.MediaType)
+			continue
+		}
+		if isAttestation(desc) {
+			slog.Info("skip attestation manifest", "digest", desc.Digest)
+			continue
+		}
+		if !matchPlatform(desc.Platform, platforms) {
+			slog.Info("skip platform", "digest", desc.Digest, "platform", desc.Platform)
+			continue
+		}
+
+		newImg, ok := patched[desc.Digest]
+		if !ok {
+			slog.Info("patch image", "digest", desc.Digest, "platform", desc.Platform)
+			srcImg, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			newImg, err = patch(srcImg)
+			if err != nil {
+				return nil, fmt.Errorf("platform %s: %w", desc.Platform, err)
+			}
+			patched[desc.Digest] = newImg
+		}
+
+		adds = append(adds, mutate.IndexAddendum{
+			Add: newImg,
+			Descriptor: v1.Descriptor{
+				Platform:    desc.Platform,
+				Annotations: desc.Annotations,
+			},
+		})
+	}
+
+	if len(adds) == 0 {
+		return nil, fmt.Errorf("no image in index matches the platforms")
+	}
+
+	return mutate.AppendManifests(newIdx, adds...), nil
+}
+
+// singleImage returns the only image of an index.
+func singleImage(idx v1.ImageIndex) (v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) != 1 {
+		return nil, fmt.Errorf("index contains %d images, select one with -platform", len(manifest.Manifests))
+	}
+	return idx.Image(manifest.Manifests[0].Digest)
+}
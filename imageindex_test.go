@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestPatchIndex(t *testing.T) {
+	adds := []mutate.IndexAddendum{}
+	for _, desc := range []v1.Descriptor{
+		{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Platform: &v1.Platform{OS: "unknown", Architecture: "unknown"}},
+		{
+			Platform:    &v1.Platform{OS: "linux", Architecture: "amd64"},
+			Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+		},
+	} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: desc})
+	}
+	idx := mutate.AppendManifests(empty.Index, adds...)
+
+	for _, tc := range []struct {
+		platforms string
+		want      []string
+	}{
+		{"", []string{"linux/amd64", "linux/arm64/v8"}},
+		{"linux/arm64", []string{"linux/arm64/v8"}},
+		{"linux/amd64,linux/s390x", []string{"linux/amd64"}},
+	} {
+		platforms, err := parsePlatforms(tc.platforms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched := 0
+		newIdx, err := patchIndex(idx, platforms, func(img v1.Image) (v1.Image, error) {
+			patched++
+			return mutate.Config(img, v1.Config{Labels: map[string]string{"patched": "true"}})
+		})
+		if err != nil {
+			t.Errorf("%s: %s", tc.platforms, err)
+			continue
+		}
+
+		manifest, err := newIdx.IndexManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, desc := range manifest.Manifests {
+			got = append(got, desc.Platform.String())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got platforms %v, want %v", tc.platforms, got, tc.want)
+		}
+		if patched != len(tc.want) {
+			t.Errorf("%s: patched %d images, want %d", tc.platforms, patched, len(tc.want))
+		}
+	}
+
+	platforms, err := parsePlatforms("windows/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = patchIndex(idx, platforms, func(img v1.Image) (v1.Image, error) {
+		return img, nil
+	})
+	if err == nil {
+		t.Error("expected error if no image matches")
+	}
+}
@@ -3,95 +3,200 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
 	"fmt"
-	"io"
+	"io/fs"
 	"log/slog"
 	"strings"
 	"time"
 
-	"github.com/dvob/pcert"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/pavel-v-chernykh/keystore-go/v4"
 	"software.sslmate.com/src/go-pkcs12"
 )
 
-func patchJKSTruststore(name string, pem []byte) patchFn {
-	return func(i *image) ([]v1.Layer, error) {
-		truststores := map[string]*tar.Header{}
-		for _, path := range i.files() {
-			if !strings.HasSuffix(path, "/lib/security/cacerts") {
-				continue
-			}
-			hdr, ok := i.resolve(path)
-			if !ok {
-				slog.Info("cant resolve link", "path", path)
-				continue
-			}
-			truststores[hdr.Name] = hdr
+// patchJKSTruststore adds the CAs to the java truststores (JKS or PKCS12).
+func patchJKSTruststore(cas []*caCert, modTime time.Time) patchFn {
+	return func(fsys fs.FS) ([]*fileChange, error) {
+		truststores, err := findJavaTruststores(fsys)
+		if err != nil {
+			return nil, err
 		}
 
-		layers := []v1.Layer{}
-		now := time.Now()
-		for path, hdr := range truststores {
-			slog.Info("prepare java truststore", "file", path)
-			r, err := i.open(path)
-			if err != nil {
-				return nil, err
-			}
-			defer r.Close()
-			oldContent, err := io.ReadAll(r)
+		changes := []*fileChange{}
+		for _, hdr := range truststores {
+			slog.Info("prepare java truststore", "file", hdr.Name)
+			oldContent, err := fs.ReadFile(fsys, hdr.Name)
 			if err != nil {
 				return nil, err
 			}
 
-			newContent, err := newJKSTruststore(oldContent, name, pem)
+			certs, err := readJavaTruststore(oldContent, "changeit")
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("failed to read java truststore '%s': %w", hdr.Name, err)
+			}
+			missing, trusted := splitTrusted(cas, certFingerprints(certs), hdr.Name)
+			if len(missing) == 0 {
+				changes = append(changes, &fileChange{
+					hdr:       hdr,
+					storeType: javaStoreType(oldContent),
+					trusted:   trusted,
+					unchanged: true,
+				})
+				continue
 			}
 
-			layer, err := newLayer(hdr, now, newContent)
+			newContent, err := newJKSTruststore(oldContent, missing, modTime)
 			if err != nil {
 				return nil, err
 			}
-			layers = append(layers, layer)
+
+			newHdr := *hdr
+			newHdr.ModTime = modTime
+			changes = append(changes, &fileChange{
+				hdr:       &newHdr,
+				content:   newContent,
+				storeType: javaStoreType(oldContent),
+				trusted:   trusted,
+			})
 		}
-		return layers, nil
+		return changes, nil
 	}
 }
 
-func newPKCS12Truststore(currentFile []byte, caFile []byte) ([]byte, error) {
-	cert, err := pcert.Parse(caFile)
+// findJavaTruststores returns the headers of the java truststores
+// (*/lib/security/cacerts) in fsys.
+func findJavaTruststores(fsys fs.FS) ([]*tar.Header, error) {
+	// several paths can be links to the same file
+	truststores := []*tar.Header{}
+	seen := map[string]bool{}
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, "/lib/security/cacerts") {
+			return nil
+		}
+		hdr, err := fileHeader(fsys, path)
+		if err != nil {
+			slog.Info("cant resolve link", "path", path, "err", err)
+			return nil
+		}
+		if hdr.Typeflag == tar.TypeReg && !seen[hdr.Name] {
+			seen[hdr.Name] = true
+			truststores = append(truststores, hdr)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	certs, err := pkcs12.DecodeTrustStore(currentFile, "")
+	return truststores, nil
+}
+
+// javaStoreType returns whether a java truststore is a JKS or a PKCS12 file.
+func javaStoreType(content []byte) string {
+	if bytes.HasPrefix(content, []byte{0xfe, 0xed, 0xfe, 0xed}) {
+		return storeJKS
+	}
+	return storePKCS12
+}
+
+// newPKCS12Truststore adds the CAs to a PKCS12 truststore. The truststore is
+// written with the password it has been decoded with (see
+// decodePKCS12Truststore).
+func newPKCS12Truststore(currentFile []byte, cas []*caCert, password string) ([]byte, error) {
+	certs, password, err := decodePKCS12Truststore(currentFile, password)
 	if err != nil {
 		return nil, err
 	}
-	certs = append(certs, cert)
+	for _, ca := range cas {
+		certs = append(certs, ca.cert)
+	}
+	return encodePKCS12Truststore(certs, password)
+}
+
+// decodePKCS12Truststore returns the certificates of a PKCS12 truststore and
+// the password it has been decoded with. If password does not match, the
+// truststore is decoded without password.
+func decodePKCS12Truststore(content []byte, password string) ([]*x509.Certificate, string, error) {
+	certs, err := pkcs12.DecodeTrustStore(content, password)
+	if err != nil && password != "" {
+		if certs, err := pkcs12.DecodeTrustStore(content, ""); err == nil {
+			return certs, "", nil
+		}
+	}
+	return certs, password, err
+}
+
+// encodePKCS12Truststore encodes a PKCS12 truststore with password. The
+// salts are derived from the certificates, so that the output is
+// reproducible.
+func encodePKCS12Truststore(certs []*x509.Certificate, password string) ([]byte, error) {
+	if password == "" {
+		return pkcs12.Passwordless.EncodeTrustStore(certs, "")
+	}
+	h := sha256.New()
+	for _, cert := range certs {
+		h.Write(cert.Raw)
+	}
+	return pkcs12.Legacy.WithRand(&saltReader{seed: h.Sum(nil)}).EncodeTrustStore(certs, password)
+}
+
+// saltReader returns a deterministic byte stream, which is the SHA-256 of
+// the seed and a counter for each block.
+type saltReader struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
 
-	return pkcs12.Passwordless.EncodeTrustStore(certs, "")
+func (r *saltReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			block := sha256.Sum256(binary.BigEndian.AppendUint64(r.seed, r.counter))
+			r.buf = block[:]
+			r.counter++
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
 }
 
-func newJKSTruststore(currentFile []byte, name string, caFile []byte) ([]byte, error) {
-	ks := keystore.New()
+func newJKSTruststore(currentFile []byte, cas []*caCert, creationTime time.Time) ([]byte, error) {
+	// ordered aliases make the output reproducible
+	ks := keystore.New(keystore.WithOrderedAliases())
 	err := ks.Load(bytes.NewBuffer(currentFile), []byte("changeit"))
 	if err != nil {
 		if err.Error() == "got invalid magic" {
-			return newPKCS12Truststore(currentFile, caFile)
+			return newPKCS12Truststore(currentFile, cas, "changeit")
 		}
 		return nil, fmt.Errorf("failed to load java key store: %w", err)
 	}
 
-	err = ks.SetTrustedCertificateEntry(name, keystore.TrustedCertificateEntry{
-		CreationTime: time.Now(),
-		Certificate: keystore.Certificate{
-			Type:    "X509",
-			Content: caFile,
-		},
-	})
-	if err != nil {
-		return nil, err
+	// existing entries with the same alias are not replaced
+	aliases := map[string]bool{}
+	for _, alias := range ks.Aliases() {
+		aliases[alias] = true
+	}
+	for _, ca := range cas {
+		alias := uniqueName(ca.name, aliases)
+		aliases[alias] = true
+		err = ks.SetTrustedCertificateEntry(alias, keystore.TrustedCertificateEntry{
+			CreationTime: creationTime,
+			Certificate: keystore.Certificate{
+				Type:    "X509",
+				Content: ca.cert.Raw,
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	newJKS := &bytes.Buffer{}
@@ -101,3 +206,49 @@ func newJKSTruststore(currentFile []byte, name string, caFile []byte) ([]byte, e
 	}
 	return newJKS.Bytes(), nil
 }
+
+// readJavaTruststore returns the trusted certificates of a JKS or PKCS12
+// truststore. PKCS12 truststores without password are read as well.
+func readJavaTruststore(content []byte, password string) ([]*x509.Certificate, error) {
+	if javaStoreType(content) == storePKCS12 {
+		certs, _, err := decodePKCS12Truststore(content, password)
+		return certs, err
+	}
+
+	ks := keystore.New(keystore.WithOrderedAliases())
+	err := ks.Load(bytes.NewReader(content), []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load java key store: %w", err)
+	}
+	certs := []*x509.Certificate{}
+	for _, alias := range ks.Aliases() {
+		if !ks.IsTrustedCertificateEntry(alias) {
+			continue
+		}
+		cert, err := trustedCertificate(ks, alias)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// trustedCertificate returns the certificate of the trusted certificate
+// entry alias.
+func trustedCertificate(ks keystore.KeyStore, alias string) (*x509.Certificate, error) {
+	entry, err := ks.GetTrustedCertificateEntry(alias)
+	if err != nil {
+		return nil, err
+	}
+	content := entry.Certificate.Content
+	// older versions of the injector stored PEM instead of DER
+	if block, _ := pem.Decode(content); block != nil {
+		content = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate '%s': %w", alias, err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/pavel-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestPatchJKSTruststore(t *testing.T) {
+	cas := []*caCert{newTestCA(t, "myca"), newTestCA(t, "issuing")}
+
+	jks := &bytes.Buffer{}
+	err := keystore.New().Store(jks, []byte("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := pkcs12.Passwordless.EncodeTrustStore(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"usr/lib/jvm/java-11/lib/security/cacerts": {Data: jks.Bytes()},
+		"opt/java/openjdk/lib/security/cacerts":    {Data: p12},
+		"etc/ssl/certs/java/cacerts":               {Data: []byte("not in a java home")},
+	}
+
+	changes, err := patchJKSTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes, want 2", len(changes))
+	}
+
+	again, err := patchJKSTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range changes {
+		if !bytes.Equal(changes[i].content, again[i].content) {
+			t.Errorf("%s: output is not reproducible", changes[i].hdr.Name)
+		}
+	}
+
+	// CAs which are already trusted are not added again
+	patched := fstest.MapFS{}
+	for _, c := range changes {
+		patched[c.hdr.Name] = &fstest.MapFile{Data: c.content}
+	}
+	unchanged, err := patchJKSTruststore(cas, time.Time{})(patched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range unchanged {
+		if !c.unchanged || len(c.trusted) != len(cas) {
+			t.Errorf("%s: CAs are added again", c.hdr.Name)
+		}
+	}
+
+	for _, c := range changes {
+		switch c.hdr.Name {
+		case "usr/lib/jvm/java-11/lib/security/cacerts":
+			if c.storeType != storeJKS {
+				t.Errorf("%s: got type %s", c.hdr.Name, c.storeType)
+			}
+			ks := keystore.New()
+			err := ks.Load(bytes.NewReader(c.content), []byte("changeit"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ca := range cas {
+				entry, err := ks.GetTrustedCertificateEntry(ca.name)
+				if err != nil {
+					t.Fatalf("%s: %s", c.hdr.Name, err)
+				}
+				if !bytes.Equal(entry.Certificate.Content, ca.cert.Raw) {
+					t.Errorf("%s: certificate of %s is not DER encoded", c.hdr.Name, ca.name)
+				}
+			}
+		case "opt/java/openjdk/lib/security/cacerts":
+			if c.storeType != storePKCS12 {
+				t.Errorf("%s: got type %s", c.hdr.Name, c.storeType)
+			}
+			certs, err := pkcs12.DecodeTrustStore(c.content, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(certs) != len(cas) {
+				t.Fatalf("%s: got %d certificates, want %d", c.hdr.Name, len(certs), len(cas))
+			}
+			for i, ca := range cas {
+				if !certs[i].Equal(ca.cert) {
+					t.Errorf("%s: CA %s missing", c.hdr.Name, ca.name)
+				}
+			}
+		default:
+			t.Errorf("unexpected change %s", c.hdr.Name)
+		}
+	}
+}
+
+func TestPatchPKCS12TruststorePassword(t *testing.T) {
+	existing := newTestCA(t, "existing")
+	cas := []*caCert{newTestCA(t, "myca")}
+
+	p12, err := pkcs12.LegacyRC2.EncodeTrustStore([]*x509.Certificate{existing.cert}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{
+		"opt/java/openjdk/lib/security/cacerts": {Data: p12},
+	}
+
+	changes, err := patchJKSTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(changes))
+	}
+
+	again, err := patchJKSTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(changes[0].content, again[0].content) {
+		t.Error("output is not reproducible")
+	}
+
+	// the password of the truststore is kept
+	_, err = pkcs12.DecodeTrustStore(changes[0].content, "")
+	if err == nil {
+		t.Error("truststore has been written without password")
+	}
+	certs, err := pkcs12.DecodeTrustStore(changes[0].content, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(existing.cert) || !certs[1].Equal(cas[0].cert) {
+		t.Errorf("got %d certificates, want the existing CA and myca", len(certs))
+	}
+}
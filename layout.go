@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// refNameAnnotation is the annotation used in the index.json of an OCI image
+// layout to store the tag of an image.
+// https://github.com/opencontainers/image-spec/blob/main/annotations.md
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// getLayoutImage returns the image or image index referenced by a tag or
+// digest from the layout at path and its org.opencontainers.image.ref.name
+// annotation, which is empty if the manifest has none.
+func getLayoutImage(path string, ref string) (mutate.Appendable, string, error) {
+	p, err := layout.FromPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, "", err
+	}
+
+	desc, err := findLayoutDescriptor(index, ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	var img mutate.Appendable
+	switch {
+	case desc.MediaType.IsImage():
+		img, err = index.Image(desc.Digest)
+	case desc.MediaType.IsIndex():
+		img, err = index.ImageIndex(desc.Digest)
+	default:
+		return nil, "", fmt.Errorf("%s: '%s' has unsupported media type %s", path, desc.Digest, desc.MediaType)
+	}
+	return img, desc.Annotations[refNameAnnotation], err
+}
+
+// findLayoutDescriptor looks up the manifest referenced by a tag or digest in
+// the index of a layout. If ref is empty the index must contain exactly one
+// manifest.
+func findLayoutDescriptor(index v1.ImageIndex, ref string) (*v1.Descriptor, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	if ref == "" {
+		if len(manifest.Manifests) != 1 {
+			return nil, fmt.Errorf("layout contains %d manifests, specify a tag or digest", len(manifest.Manifests))
+		}
+		return &manifest.Manifests[0], nil
+	}
+
+	digest, digestErr := v1.NewHash(ref)
+	for i, desc := range manifest.Manifests {
+		if digestErr == nil && desc.Digest == digest {
+			return &manifest.Manifests[i], nil
+		}
+		if desc.Annotations[refNameAnnotation] == ref {
+			return &manifest.Manifests[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no manifest found for '%s'", ref)
+}
+
+// putLayoutImage writes an image or image index into the layout at path.
+// The layout is created if it does not exist. An existing manifest with the
+// same tag gets replaced, all other manifests in the index are kept.
+func putLayoutImage(path string, ref string, img mutate.Appendable) error {
+	if _, err := v1.NewHash(ref); err == nil {
+		return fmt.Errorf("cannot write to a digest, use a tag instead of '%s'", ref)
+	}
+
+	p, err := layout.FromPath(path)
+	if errors.Is(err, os.ErrNotExist) {
+		p, err = layout.Write(path, empty.Index)
+	}
+	if err != nil {
+		return err
+	}
+
+	options := []layout.Option{}
+	var matcher match.Matcher = func(v1.Descriptor) bool { return false }
+	if ref != "" {
+		options = append(options, layout.WithAnnotations(map[string]string{
+			refNameAnnotation: ref,
+		}))
+		matcher = match.Annotation(refNameAnnotation, ref)
+	}
+
+	switch img := img.(type) {
+	case v1.ImageIndex:
+		return p.ReplaceIndex(img, matcher, options...)
+	case v1.Image:
+		return p.ReplaceImage(img, matcher, options...)
+	default:
+		return fmt.Errorf("unsupported type %T", img)
+	}
+}
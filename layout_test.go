@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestPutLayoutImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirror")
+
+	images := map[string]v1.Image{}
+	for _, tag := range []string{"a", "b", "a"} {
+		img, err := random.Image(64, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = putLayoutImage(path, tag, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		images[tag] = img
+	}
+
+	p, err := layout.FromPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := p.ImageIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Manifests) != 2 {
+		t.Fatalf("got %d manifests, want 2", len(manifest.Manifests))
+	}
+
+	for tag, img := range images {
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ref := range []string{tag, digest.String()} {
+			desc, err := findLayoutDescriptor(index, ref)
+			if err != nil {
+				t.Errorf("%s: %s", ref, err)
+				continue
+			}
+			if desc.Digest != digest {
+				t.Errorf("%s: got %s, want %s", ref, desc.Digest, digest)
+			}
+
+			_, srcName, err := getLayoutImage(path, ref)
+			if err != nil {
+				t.Errorf("%s: %s", ref, err)
+				continue
+			}
+			if srcName != tag {
+				t.Errorf("%s: got name '%s', want '%s'", ref, srcName, tag)
+			}
+		}
+	}
+
+	for _, ref := range []string{"", "c"} {
+		_, err := findLayoutDescriptor(index, ref)
+		if err == nil {
+			t.Errorf("'%s': expected error", ref)
+		}
+	}
+
+	digest, err := images["a"].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putLayoutImage(path, digest.String(), images["a"])
+	if err == nil {
+		t.Error("expected error when writing to a digest")
+	}
+}
@@ -1,22 +1,42 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
-	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 )
 
+// version is set at build time with -ldflags "-X main.version=VERSION".
+var version string
+
+// toolVersion returns the version of the injector. Without a version set at
+// build time the module version is used (e.g. for go install).
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
 func main() {
 	if err := run(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -25,30 +45,129 @@ func main() {
 }
 
 func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		return runCache(os.Args[2:])
+	}
+
 	var (
 		opts = &opts{
-			srcType: "remote",
-			dstType: "remote",
+			dstTemplate:     os.Getenv("IMAGE_CA_INJECTOR_DST_TEMPLATE"),
+			caStorePassword: "changeit",
+			layerFormat: layerFormat{
+				compression: compressionGzip,
+			},
+			cache: layerCache{
+				dir: os.Getenv("IMAGE_CA_INJECTOR_CACHE_DIR"),
+			},
+			registry: registryOptions{
+				retries:    2,
+				retryDelay: time.Second,
+			},
 		}
 	)
 
-	flag.StringVar(&opts.srcType, "src", opts.srcType, "source type (remote, docker, tar)")
-	flag.StringVar(&opts.dstType, "dst", opts.dstType, "destination type (remote, docker, tar)")
+	caFiles := stringList{}
+	flag.Var(&caFiles, "ca", "file (PEM, DER, PKCS#7, JKS or PKCS12) or directory with the CAs to inject or remove. files can contain several certificates. can be specified multiple times. if set, all arguments after SOURCE are destinations")
+	flag.BoolVar(&opts.remove, "remove", opts.remove, "remove the CAs selected with -ca, -remove-fingerprint and -remove-subject from the truststores instead of injecting them. all arguments after SOURCE are destinations")
+	flag.Var(&opts.removeFingerprints, "remove-fingerprint", "SHA-256 fingerprint of a CA to remove. can be specified multiple times")
+	flag.Var(&opts.removeSubjects, "remove-subject", "subject of a CA to remove (e.g. 'CN=My CA,O=Corp'). can be specified multiple times")
+	flag.StringVar(&opts.caStorePassword, "ca-store-password", opts.caStorePassword, "password of JKS and PKCS12 truststores which are used as CA input")
+	flag.BoolVar(&opts.allowInvalidCA, "allow-invalid-ca", opts.allowInvalidCA, "inject CAs even if they are no CA certificates, expired or not yet valid")
+	flag.StringVar(&opts.platforms, "platform", opts.platforms, "comma separated list of platforms to process if the source is a multi-platform image (e.g. linux/amd64,linux/arm64). all platforms if empty")
+
+	flag.StringVar(&opts.registry.caFile, "registry-ca", opts.registry.caFile, "PEM file with additional CAs to verify the TLS certificates of registries")
+	flag.Var(&opts.registry.insecure, "insecure-registry", "registry (host[:port]) which is accessed without TLS verification or via plain HTTP. can be specified multiple times")
+	flag.StringVar(&opts.registry.clientCert, "registry-cert", opts.registry.clientCert, "client certificate for TLS client authentication against registries")
+	flag.StringVar(&opts.registry.clientKey, "registry-key", opts.registry.clientKey, "client key for TLS client authentication against registries")
+	flag.IntVar(&opts.registry.retries, "retries", opts.registry.retries, "number of retries of failed registry requests")
+	flag.DurationVar(&opts.registry.retryDelay, "retry-delay", opts.registry.retryDelay, "delay before the first retry. the delay triples after each retry")
+	flag.StringVar(&opts.registry.userAgent, "user-agent", opts.registry.userAgent, "user agent for registry requests")
+
+	flag.StringVar(&opts.dstTemplate, "dst-template", opts.dstTemplate, "destination template which is used if no DESTINATION is specified (env IMAGE_CA_INJECTOR_DST_TEMPLATE)")
+
+	flag.StringVar(&opts.report, "report", opts.report, "write a JSON report of the patched files and written images to this file (- for stdout)")
+
+	flag.BoolVar(&opts.force, "force", opts.force, "write the destinations even if they are up to date (same source digest and CAs)")
+
+	flag.StringVar(&opts.layerFormat.compression, "compression", opts.layerFormat.compression, "compression of the added layer: gzip, zstd or none. zstd requires an OCI image")
+	flag.IntVar(&opts.layerFormat.level, "compression-level", opts.layerFormat.level, "compression level of the added layer (gzip 1-9, zstd 1-22). the default level is used if 0")
+	flag.BoolVar(&opts.layerPerPatcher, "layer-per-patcher", opts.layerPerPatcher, "add a separate layer for the changes of each patcher (PEM bundles, CA directories, java truststores) instead of a single layer. useful for debugging")
+
+	flag.StringVar(&opts.cache.dir, "cache-dir", opts.cache.dir, "directory in which the file indexes of the layers are cached. no cache if empty (env IMAGE_CA_INJECTOR_CACHE_DIR)")
+	flag.Func("cache-max-size", "prune the cache to this size after a run (e.g. 512M, 10G). no limit if 0", func(s string) error {
+		size, err := parseSize(s)
+		opts.cache.maxSize = size
+		return err
+	})
+	flag.BoolVar(&opts.cache.blobs, "cache-blobs", opts.cache.blobs, "cache the content of the truststores, so that cached layers do not have to be downloaded to read them")
+
+	var authFile string
+	flag.Func("src-creds", "USERNAME[:PASSWORD] for the source registry", opts.srcCreds.setCreds)
+	flag.Func("dst-creds", "USERNAME[:PASSWORD] for the destination registry", opts.dstCreds.setCreds)
+	flag.StringVar(&opts.srcCreds.token, "src-registry-token", opts.srcCreds.token, "bearer token for the source registry")
+	flag.StringVar(&opts.dstCreds.token, "dst-registry-token", opts.dstCreds.token, "bearer token for the destination registry")
+	flag.StringVar(&opts.srcCreds.authFile, "src-authfile", opts.srcCreds.authFile, "docker config.json with the credentials for the source registry")
+	flag.StringVar(&opts.dstCreds.authFile, "dst-authfile", opts.dstCreds.authFile, "docker config.json with the credentials for the destination registry")
+	flag.StringVar(&authFile, "authfile", authFile, "docker config.json with the credentials for the source and destination registry")
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s SOURCE DESTINATION CA_FILE:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [OPTIONS] SOURCE [DESTINATION...] CA_FILE
+       %[1]s [OPTIONS] -ca CA_FILE|CA_DIR... SOURCE [DESTINATION...]
+       %[1]s [OPTIONS] -remove [-ca CA_FILE|CA_DIR...] [-remove-fingerprint SHA256...] [-remove-subject SUBJECT...] SOURCE [DESTINATION...]
+       %[1]s cache prune [OPTIONS]
+
+SOURCE and DESTINATION are image references with an optional transport:
+  docker://REFERENCE              image in a registry (default if no transport is given)
+  docker-daemon:REFERENCE         image in the local docker daemon
+  docker-archive:PATH[:REFERENCE] tarball created with docker save
+  oci:PATH[:TAG]                  OCI image layout
+  oci:PATH@DIGEST                 OCI image layout
+
+DESTINATION can be a Go template which is evaluated with the following fields
+of the source: .Registry, .Repository, .Name, .Tag, .Digest, .ShortDigest
+(e.g. registry.corp/mirror/{{ .Name }}:{{ .Tag }}-ca). Without DESTINATION
+the template configured with -dst-template is used.
+
+Options:
+`, os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	if flag.NArg() < 3 {
-		return fmt.Errorf("missing arguments. want SOURCE DESTINATION CAFILE")
+	if len(caFiles) > 0 || opts.remove {
+		if flag.NArg() < 1 {
+			return fmt.Errorf("missing arguments. want SOURCE [DESTINATION...]")
+		}
+		opts.src = flag.Arg(0)
+		opts.dsts = flag.Args()[1:]
+		opts.caFiles = caFiles
+	} else {
+		if flag.NArg() < 2 {
+			return fmt.Errorf("missing arguments. want SOURCE [DESTINATION...] CAFILE")
+		}
+		opts.src = flag.Arg(0)
+		opts.dsts = flag.Args()[1 : flag.NArg()-1]
+		opts.caFiles = []string{flag.Arg(flag.NArg() - 1)}
+	}
+
+	if opts.srcCreds.authFile == "" {
+		opts.srcCreds.authFile = authFile
+	}
+	if opts.dstCreds.authFile == "" {
+		opts.dstCreds.authFile = authFile
+	}
+	if epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH '%s': %w", epoch, err)
+		}
+		t := time.Unix(sec, 0).UTC()
+		opts.sourceDateEpoch = &t
 	}
 
-	opts.src = flag.Arg(0)
-	opts.dst = flag.Arg(1)
-	opts.caFile = flag.Arg(2)
+	opts.srcCreds.fromEnv("IMAGE_CA_INJECTOR_SRC")
+	opts.dstCreds.fromEnv("IMAGE_CA_INJECTOR_DST")
 
 	logs.Progress.SetOutput(os.Stderr)
 
@@ -56,133 +175,790 @@ func run() error {
 
 }
 
+// runCache runs the cache subcommands.
+func runCache(args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("unknown cache command. want: cache prune [OPTIONS]")
+	}
+
+	cache := &layerCache{
+		dir: os.Getenv("IMAGE_CA_INJECTOR_CACHE_DIR"),
+	}
+	var maxSize int64
+	fs := flag.NewFlagSet("cache prune", flag.ContinueOnError)
+	fs.StringVar(&cache.dir, "cache-dir", cache.dir, "cache directory (env IMAGE_CA_INJECTOR_CACHE_DIR)")
+	fs.Func("max-size", "remove the least recently used files until the cache is not larger than this size (e.g. 512M, 10G). all cached files are removed if 0", func(s string) error {
+		var err error
+		maxSize, err = parseSize(s)
+		return err
+	})
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if cache.dir == "" {
+		return fmt.Errorf("no cache directory configured")
+	}
+
+	removed, err := cache.prune(maxSize)
+	if err != nil {
+		return err
+	}
+	slog.Info("cache pruned", "dir", cache.dir, "removed_bytes", removed)
+	return nil
+}
+
 type opts struct {
-	src     string
-	dst     string
-	srcType string
-	dstType string
-	caFile  string
+	src       string
+	dsts      []string
+	caFiles   []string
+	platforms string
+	registry  registryOptions
+	srcCreds  credentials
+	dstCreds  credentials
+
+	// dstTemplate is used if no destination is specified
+	dstTemplate string
+
+	// report is the path of the JSON report
+	report string
+
+	// caStorePassword is the password of JKS and PKCS12 truststores in
+	// caFiles
+	caStorePassword string
+
+	// allowInvalidCA injects certificates which fail the validation of
+	// validateCA
+	allowInvalidCA bool
+
+	// remove removes the CAs of caFiles, removeFingerprints and
+	// removeSubjects instead of injecting them
+	remove             bool
+	removeFingerprints stringList
+	removeSubjects     stringList
+
+	// force disables the check whether the destinations are up to date
+	force bool
+
+	// cache is disabled if cache.dir is empty
+	cache layerCache
+
+	// layerPerPatcher adds a layer per patcher instead of a single layer
+	layerPerPatcher bool
+
+	layerFormat layerFormat
+
+	// sourceDateEpoch is the timestamp of the changed files (env
+	// SOURCE_DATE_EPOCH). If it is not set the creation time of the source
+	// image is used.
+	sourceDateEpoch *time.Time
+}
+
+// stringList is a flag which can be specified multiple times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 func injectCA(opts *opts) error {
-	caPEM, err := os.ReadFile(opts.caFile)
+	var (
+		cas []*caCert
+		err error
+	)
+	if !opts.remove || len(opts.caFiles) > 0 {
+		cas, err = loadCAs(opts.caFiles, opts.caStorePassword)
+		if err != nil {
+			return err
+		}
+	}
+
+	platforms, err := parsePlatforms(opts.platforms)
 	if err != nil {
 		return err
 	}
 
-	slog.Info("read image", "src", opts.src, "src_type", opts.srcType)
-	srcImg, err := getImage(opts.srcType, opts.src)
+	// zstd is checked per image since it depends on the manifest type
+	_, err = opts.layerFormat.mediaType(types.OCIManifestSchema1)
 	if err != nil {
 		return err
 	}
 
-	image, err := newImage(srcImg)
+	srcRef, err := parseReference(opts.src)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid source: %w", err)
+	}
+
+	dsts := opts.dsts
+	if len(dsts) == 0 {
+		if opts.dstTemplate == "" {
+			return fmt.Errorf("no destination and no destination template configured")
+		}
+		dsts = []string{opts.dstTemplate}
 	}
-	defer image.close()
 
-	fileName := filepath.Base(opts.caFile)
+	// templates are evaluated after the source has been read
+	for _, dst := range dsts {
+		if isTemplate(dst) {
+			continue
+		}
+		_, err := parseReference(dst)
+		if err != nil {
+			return fmt.Errorf("invalid destination: %w", err)
+		}
+	}
 
-	patch := chainPatchFns(
-		patchPEMTruststore(caPEM),
-		putPEMTruststore(fileName, caPEM),
-		patchJKSTruststore(fileName, caPEM),
+	now := time.Now()
+	for _, ca := range cas {
+		slog.Info("load CA", "name", ca.name, "subject", ca.cert.Subject, "fingerprint", ca.fingerprint())
+		// CAs are removed regardless of their validity
+		if opts.remove {
+			continue
+		}
+		for _, warning := range caWarnings(ca.cert) {
+			slog.Warn("weak CA", "name", ca.name, "warning", warning)
+		}
+		err := validateCA(ca.cert, now)
+		if err == nil {
+			continue
+		}
+		if !opts.allowInvalidCA {
+			return fmt.Errorf("invalid CA '%s' (%s, sha256 %s): %w. use -allow-invalid-ca to inject it anyway", ca.name, ca.cert.Subject, ca.fingerprint(), err)
+		}
+		slog.Warn("inject invalid CA", "name", ca.name, "err", err)
+	}
+	var (
+		patches   func(modTime time.Time) []patchFn
+		createdBy string
+		comment   string
+
+		// caAnnotations are added to the manifests and are used to check
+		// whether a destination is up to date. caLabels are added to the
+		// image config.
+		caAnnotations map[string]string
+		caLabels      map[string]string
 	)
+	if opts.remove {
+		sel, err := newCASelector(cas, opts.removeFingerprints, opts.removeSubjects)
+		if err != nil {
+			return err
+		}
+		fingerprints := sel.sortedFingerprints()
+		subjects := sel.sortedSubjects()
+		patches = func(modTime time.Time) []patchFn {
+			return []patchFn{
+				removePEMTruststore(sel, modTime),
+				removeAnchors(sel, modTime),
+				removeJKSTruststore(sel, modTime),
+			}
+		}
+		createdBy = "remove CA from"
+		comment = "removed CA " + strings.Join(append(fingerprints, subjects...), "; ")
+		caAnnotations = map[string]string{
+			caRemovedAnnotation:         strings.Join(fingerprints, ","),
+			caRemovedSubjectsAnnotation: strings.Join(subjects, "; "),
+		}
+		caLabels = caAnnotations
+	} else {
+		fingerprints := caFingerprints(cas)
+		subjects := caSubjects(cas)
+		patches = func(modTime time.Time) []patchFn {
+			return []patchFn{
+				patchPEMTruststore(cas, modTime),
+				putPEMTruststore(cas, modTime),
+				patchJKSTruststore(cas, modTime),
+			}
+		}
+		createdBy = "add CA to"
+		comment = "CA " + strings.Join(subjects, "; ")
+		caAnnotations = map[string]string{
+			caFingerprintsAnnotation: strings.Join(fingerprints, ","),
+		}
+		// labels of a previous removal do not apply anymore
+		caLabels = map[string]string{
+			caFingerprintsAnnotation:    strings.Join(fingerprints, ","),
+			caSubjectsLabel:             strings.Join(subjects, "; "),
+			caRemovedAnnotation:         "",
+			caRemovedSubjectsAnnotation: "",
+		}
+	}
 
-	slog.Info("prepare truststore patches")
-	layers, err := patch(image)
+	// the platforms and the layer format are recorded as well, so that a
+	// destination written with other options is not up to date
+	annotations := map[string]string{
+		platformsAnnotation:   formatPlatforms(platforms),
+		compressionAnnotation: opts.layerFormat.String(),
+	}
+	for k, v := range caAnnotations {
+		annotations[k] = v
+	}
+
+	// baseName is set once the source has been read
+	var baseName string
+
+	var cache *layerCache
+	if opts.cache.dir != "" {
+		cache = &opts.cache
+		defer func() {
+			if cache.maxSize == 0 {
+				return
+			}
+			removed, err := cache.prune(cache.maxSize)
+			if err != nil {
+				slog.Warn("failed to prune cache", "dir", cache.dir, "err", err)
+				return
+			}
+			slog.Info("cache pruned", "dir", cache.dir, "removed_bytes", removed)
+		}()
+	}
+
+	rep := newReport()
+
+	patchAndAnnotate := func(srcImg v1.Image) (v1.Image, error) {
+		image, err := newImage(srcImg, cache)
+		if err != nil {
+			return nil, err
+		}
+
+		imgReport, err := newImageReport(srcImg)
+		if err != nil {
+			return nil, err
+		}
+		rep.Images = append(rep.Images, imgReport)
+
+		modTime, err := patchTime(srcImg, opts.sourceDateEpoch)
+		if err != nil {
+			return nil, err
+		}
+
+		history := v1.History{
+			Created:   v1.Time{Time: modTime},
+			CreatedBy: fmt.Sprintf("image-ca-injector %s: %s", toolVersion(), createdBy),
+			Comment:   comment,
+		}
+		newImg, err := patchImage(image, patches(modTime), opts.layerPerPatcher, &opts.layerFormat, history, imgReport)
+		if err != nil {
+			return nil, err
+		}
+		imgLabels := caLabels
+		if opts.remove {
+			imgLabels, err = remainingCALabels(srcImg, imgReport, caLabels)
+			if err != nil {
+				return nil, err
+			}
+		}
+		newImg, err = label(newImg, srcImg, baseName, imgLabels)
+		if err != nil {
+			return nil, err
+		}
+		newImg = annotate(newImg, srcImg, baseName, annotations).(v1.Image)
+
+		digest, err := newImg.Digest()
+		if err != nil {
+			return nil, err
+		}
+		imgReport.Digest = digest.String()
+		return newImg, nil
+	}
+
+	slog.Info("read image", "src", srcRef)
+	src, srcName, err := getImage(srcRef, &opts.registry, &opts.srcCreds)
+	if err != nil {
+		return err
+	}
+	srcNameRef := sourceName(srcRef, srcName)
+	if srcNameRef != nil {
+		baseName = srcNameRef.Name()
+	} else if srcRef.transport == transportOCI {
+		// a tag within the layout (e.g. alpine-3.18)
+		baseName = srcName
+	}
+
+	srcDigest, err := src.Digest()
 	if err != nil {
-		return fmt.Errorf("failed to prepare patches: %w", err)
+		return err
+	}
+	rep.Source = sourceReport{
+		Reference: srcRef.String(),
+		Digest:    srcDigest.String(),
 	}
 
-	newImg, err := mutate.AppendLayers(image.image(), layers...)
+	dstRefs, err := resolveDestinations(dsts, newTemplateData(srcNameRef, srcDigest))
 	if err != nil {
-		return fmt.Errorf("failed to append layers: %w", err)
+		return err
 	}
 
-	if opts.srcType == "remote" || opts.srcType == "docker" {
-		annotations := map[string]string{}
-		digest, err := srcImg.Digest()
+	if _, ok := src.(v1.ImageIndex); ok && srcRef.transport == transportArchive {
+		err := checkMultiImageDestinations(dstRefs)
 		if err != nil {
-			slog.Warn("failed to obtain digest from source image", "err", err)
-		} else {
-			annotations["org.opencontainers.image.base.digest"] = digest.String()
+			return err
+		}
+	}
+
+	err = checkDestinationCredentials(dstRefs, &opts.registry, &opts.dstCreds)
+	if err != nil {
+		return err
+	}
+
+	if !opts.force {
+		outdated := []*reference{}
+		for _, dstRef := range dstRefs {
+			ok, digest := upToDate(dstRef, &opts.registry, &opts.dstCreds, srcDigest, annotations)
+			if !ok {
+				outdated = append(outdated, dstRef)
+				continue
+			}
+			slog.Info("destination is up to date", "dst", dstRef, "digest", digest)
+			rep.Destinations = append(rep.Destinations, &destinationReport{
+				Reference: dstRef.String(),
+				Name:      digestName(dstRef, &opts.registry, digest),
+				Digest:    digest.String(),
+				UpToDate:  true,
+			})
 		}
+		dstRefs = outdated
+	}
+
+	if len(dstRefs) == 0 {
+		slog.Info("all destinations are up to date")
+		if opts.report != "" {
+			return rep.write(opts.report)
+		}
+		return nil
+	}
 
-		ref, err := name.ParseReference(opts.src)
+	var result mutate.Appendable
+	switch src := src.(type) {
+	case v1.ImageIndex:
+		newIdx, err := patchIndex(src, platforms, patchAndAnnotate)
 		if err != nil {
 			return err
 		}
-		annotations["org.opencontainers.image.base.image"] = ref.Name()
+		newIdx = annotate(newIdx, src, baseName, annotations).(v1.ImageIndex)
+		result = newIdx
+	case v1.Image:
+		if len(platforms) != 0 {
+			if err := checkPlatform(src, platforms); err != nil {
+				return err
+			}
+		}
+		result, err = patchAndAnnotate(src)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported source %T", src)
+	}
+
+	err = putImages(dstRefs, result, &opts.registry, &opts.dstCreds, rep)
+
+	if opts.report != "" {
+		reportErr := rep.write(opts.report)
+		if reportErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to write report: %w", reportErr))
+		}
+	}
+	return err
+}
+
+func newImageReport(srcImg v1.Image) (*imageReport, error) {
+	digest, err := srcImg.Digest()
+	if err != nil {
+		return nil, err
+	}
+	r := &imageReport{
+		SourceDigest: digest.String(),
+		Files:        []*fileReport{},
+		Layers:       []*layerReport{},
+	}
+	cfg, err := srcImg.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.OS != "" {
+		r.Platform = cfg.Platform().String()
+	}
+	return r, nil
+}
+
+// patchImage applies the patches to image and returns the image with the
+// additional layer. If layerPerPatcher is true, the changes of each patch are
+// added as a separate layer. Each layer gets a copy of history with the
+// changed files appended to CreatedBy. The changes are recorded in r.
+func patchImage(image *image, patches []patchFn, layerPerPatcher bool, lf *layerFormat, history v1.History, r *imageReport) (v1.Image, error) {
+	r.OS = getOSInfo(image)
+
+	manifestType, err := image.image().MediaType()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := image.image().ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	readable := !isRootUser(cfg.Config.User)
+	layerType, err := lf.mediaType(manifestType)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("prepare truststore patches")
+	changeSets := [][]*fileChange{}
+	for _, patch := range patches {
+		changes, err := patch(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare patches: %w", err)
+		}
+		r.addFiles(changes)
+
+		// truststores which already contain all CAs are not written
+		changed := []*fileChange{}
+		for _, change := range changes {
+			if change.unchanged {
+				continue
+			}
+			change.links = image.index.hardlinks(change.hdr.Name)
+			changed = append(changed, change)
+		}
+		changes = changed
+		if len(changes) == 0 {
+			continue
+		}
+		if layerPerPatcher || len(changeSets) == 0 {
+			changeSets = append(changeSets, changes)
+			continue
+		}
+		changeSets[0] = append(changeSets[0], changes...)
+	}
+
+	layers := []v1.Layer{}
+	addendums := []mutate.Addendum{}
+	for _, changes := range changeSets {
+		layer, err := newLayer(image, changes, layerType, lf, readable)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+
+		files := []string{}
+		for _, change := range changes {
+			files = append(files, "/"+change.hdr.Name)
+		}
+		h := history
+		h.CreatedBy = fmt.Sprintf("%s %s", history.CreatedBy, strings.Join(files, " "))
+		addendums = append(addendums, mutate.Addendum{
+			Layer:   layer,
+			History: h,
+		})
+	}
+
+	err = r.addLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	newImg, err := mutate.Append(image.image(), addendums...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to append layers: %w", err)
+	}
+
+	// keep the media types of the manifest and the config consistent
+	if manifestType == types.OCIManifestSchema1 {
+		newImg = mutate.ConfigMediaType(newImg, types.OCIConfigJSON)
+	} else {
+		newImg = mutate.MediaType(newImg, types.DockerManifestSchema2)
+		newImg = mutate.ConfigMediaType(newImg, types.DockerConfigJSON)
+	}
+	return newImg, nil
+}
+
+// isRootUser returns true if the user of an image config (USER[:GROUP]) is
+// root.
+func isRootUser(user string) bool {
+	u, _, _ := strings.Cut(user, ":")
+	return u == "" || u == "root" || u == "0"
+}
+
+// patchTime returns the timestamp of the changed files. To get reproducible
+// images it is either sourceDateEpoch or the creation time of the image.
+func patchTime(img v1.Image, sourceDateEpoch *time.Time) (time.Time, error) {
+	if sourceDateEpoch != nil {
+		return *sourceDateEpoch, nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cfg.Created.IsZero() {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	return cfg.Created.UTC(), nil
+}
+
+// annotate adds the base image annotations and the annotations of the run
+// (e.g. the injected or removed CAs) to an image or index. Annotations with an
+// empty value are skipped. The base image name is only added if baseName is
+// not empty.
+func annotate(f partial.WithRawManifest, base partial.Describable, baseName string, runAnnotations map[string]string) partial.WithRawManifest {
+	annotations := map[string]string{}
+	for k, v := range runAnnotations {
+		if v != "" {
+			annotations[k] = v
+		}
+	}
+	digest, err := base.Digest()
+	if err != nil {
+		slog.Warn("failed to obtain digest from source image", "err", err)
+	} else {
+		annotations[baseDigestAnnotation] = digest.String()
+	}
+	if baseName != "" {
+		annotations[baseNameAnnotation] = baseName
+	}
+	return mutate.Annotations(f, annotations)
+}
 
-		// https://github.com/opencontainers/image-spec/blob/main/annotations.md
-		newImg = mutate.Annotations(newImg, annotations).(v1.Image)
+// label adds labels with the base image, the injected or removed CAs and the
+// version of the injector to the config of img. CA labels with an empty value
+// are removed. The base image name is only added if baseName is not empty.
+func label(img v1.Image, base v1.Image, baseName string, caLabels map[string]string) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	config := *cfg.Config.DeepCopy()
+	labels := map[string]string{}
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	for k, v := range caLabels {
+		if v == "" {
+			delete(labels, k)
+			continue
+		}
+		labels[k] = v
 	}
+	labels[versionLabel] = toolVersion()
+	digest, err := base.Digest()
+	if err != nil {
+		return nil, err
+	}
+	labels[baseDigestAnnotation] = digest.String()
+	if baseName != "" {
+		labels[baseNameAnnotation] = baseName
+	}
+	config.Labels = labels
+	return mutate.Config(img, config)
+}
 
-	slog.Info("write image", "dst", opts.dst, "dst_type", opts.dstType)
-	err = putImage(opts.dstType, opts.dst, newImg)
+// remainingCALabels returns caLabels with the labels of the CAs which have
+// been injected into img before (see caFingerprintsAnnotation and
+// caSubjectsLabel) without the CAs which have been removed according to r.
+func remainingCALabels(img v1.Image, r *imageReport, caLabels map[string]string) (map[string]string, error) {
+	cfg, err := img.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("failed to write tar: %w", err)
+		return nil, err
+	}
+	removed := map[string]bool{}
+	for _, f := range r.Files {
+		for _, ca := range f.Removed {
+			removed[ca.Fingerprint] = true
+			removed[ca.Subject] = true
+		}
+	}
+	remaining := func(value, sep string) string {
+		values := []string{}
+		for _, v := range strings.Split(value, sep) {
+			if v != "" && !removed[v] {
+				values = append(values, v)
+			}
+		}
+		return strings.Join(values, sep)
+	}
+
+	labels := map[string]string{
+		caFingerprintsAnnotation: remaining(cfg.Config.Labels[caFingerprintsAnnotation], ","),
+		caSubjectsLabel:          remaining(cfg.Config.Labels[caSubjectsLabel], "; "),
+	}
+	for k, v := range caLabels {
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// checkPlatform returns an error if img does not match one of the platforms.
+func checkPlatform(img v1.Image, platforms []v1.Platform) error {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	if !matchPlatform(cfg.Platform(), platforms) {
+		return fmt.Errorf("image platform %s does not match the requested platforms", cfg.Platform())
 	}
 	return nil
+}
 
+// resolveDestinations evaluates the destination templates and parses the
+// destinations.
+func resolveDestinations(dsts []string, data *templateData) ([]*reference, error) {
+	refs := []*reference{}
+	for _, dst := range dsts {
+		if isTemplate(dst) {
+			expanded, err := expandTemplate(dst, data)
+			if err != nil {
+				return nil, err
+			}
+			slog.Info("destination template evaluated", "template", dst, "dst", expanded)
+			dst = expanded
+		}
+		ref, err := parseReference(dst)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination: %w", err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
 }
 
-func putImage(typ string, location string, img v1.Image) error {
-	switch typ {
-	case "remote":
-		ref, err := name.ParseReference(location)
+// putImages writes img to all destinations. A failed destination does not
+// prevent the others from being written. All failures are returned.
+func putImages(refs []*reference, img mutate.Appendable, ro *registryOptions, creds *credentials, rep *report) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, ref := range refs {
+		dstReport := &destinationReport{
+			Reference: ref.String(),
+		}
+		rep.Destinations = append(rep.Destinations, dstReport)
+
+		slog.Info("write image", "dst", ref)
+		err := putImage(ref, img, ro, creds)
+		if err != nil {
+			slog.Error("failed to write image", "dst", ref, "err", err)
+			dstReport.Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to write image to '%s': %w", ref, err))
+			continue
+		}
+		dstReport.Digest = digest.String()
+		dstReport.Name = digestName(ref, ro, digest)
+		slog.Info("image written", "dst", ref, "digest", digest)
+	}
+	return errors.Join(errs...)
+}
+
+// digestName returns the reference of a written image by digest.
+func digestName(ref *reference, ro *registryOptions, digest v1.Hash) string {
+	switch ref.transport {
+	case transportRegistry:
+		r, err := ro.parseReference(ref.location)
+		if err != nil {
+			return ""
+		}
+		return r.Context().Digest(digest.String()).String()
+	case transportOCI:
+		return (&reference{transport: transportOCI, location: ref.location, tag: digest.String()}).String()
+	default:
+		return ref.String()
+	}
+}
+
+func putImage(ref *reference, src mutate.Appendable, ro *registryOptions, creds *credentials) error {
+	if idx, ok := src.(v1.ImageIndex); ok && ref.transport == transportDaemon {
+		img, err := singleImage(idx)
+		if err != nil {
+			return fmt.Errorf("transport '%s' does not support image indexes: %w", ref.transport, err)
+		}
+		src = img
+	}
+
+	switch ref.transport {
+	case transportRegistry:
+		r, err := ro.parseReference(ref.location)
+		if err != nil {
+			return err
+		}
+		options, err := makeOptions(ro, creds, r)
 		if err != nil {
 			return err
 		}
-		return remote.Write(ref, img, makeOptions()...)
+		if idx, ok := src.(v1.ImageIndex); ok {
+			return remote.WriteIndex(r, idx, options...)
+		}
+		return remote.Write(r, src.(v1.Image), options...)
 
-	case "docker":
-		tag, err := name.NewTag(location)
+	case transportDaemon:
+		tag, err := name.NewTag(ref.location)
 		if err != nil {
 			return err
 		}
-		_, err = daemon.Write(tag, img)
+		_, err = daemon.Write(tag, src.(v1.Image))
 		return err
 
-	case "file":
-		return tarball.WriteToFile(location, &name.Tag{}, img)
+	case transportArchive:
+		return putArchiveImage(ref.location, ref.tag, src)
+
+	case transportOCI:
+		return putLayoutImage(ref.location, ref.tag, src)
 
 	default:
-		return fmt.Errorf("unknown type '%s'", typ)
+		return fmt.Errorf("unknown transport '%s'", ref.transport)
 
 	}
 }
 
-func getImage(typ string, location string) (v1.Image, error) {
+// getImage returns the image or image index (v1.Image or v1.ImageIndex)
+// referenced by ref and the name of the image if it is known. The name is
+// the reference for the docker and docker-daemon transport, the tag in a
+// docker-archive and the org.opencontainers.image.ref.name in an OCI layout.
+func getImage(ref *reference, ro *registryOptions, creds *credentials) (mutate.Appendable, string, error) {
 
-	switch typ {
-	case "remote":
-		ref, err := name.ParseReference(location)
+	switch ref.transport {
+	case transportRegistry:
+		r, err := ro.parseReference(ref.location)
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		options, err := makeOptions(ro, creds, r)
+		if err != nil {
+			return nil, "", err
+		}
+		desc, err := remote.Get(r, options...)
+		if err != nil {
+			return nil, "", err
+		}
+		var img mutate.Appendable
+		if desc.MediaType.IsIndex() {
+			img, err = desc.ImageIndex()
+		} else {
+			img, err = desc.Image()
 		}
-		return remote.Image(ref, makeOptions()...)
+		return img, ref.location, err
 
-	case "docker":
-		ref, err := name.ParseReference(location)
+	case transportDaemon:
+		r, err := name.ParseReference(ref.location)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		return daemon.Image(ref)
+		img, err := daemon.Image(r)
+		return img, ref.location, err
 
-	case "file":
-		return tarball.ImageFromPath(location, &name.Tag{})
+	case transportArchive:
+		return getArchiveImage(ref.location, ref.tag)
 
-	default:
-		return nil, fmt.Errorf("unknown type '%s'", typ)
+	case transportOCI:
+		return getLayoutImage(ref.location, ref.tag)
 
-	}
-}
+	default:
+		return nil, "", fmt.Errorf("unknown transport '%s'", ref.transport)
 
-func makeOptions() []remote.Option {
-	return []remote.Option{
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
 	}
 }
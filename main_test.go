@@ -178,11 +178,9 @@ func TestAddCA(t *testing.T) {
 		pull(t, pool.Client, "alpine", "latest")
 
 		err = injectCA(&opts{
-			src:     "alpine",
-			dst:     "myalpine",
-			srcType: "docker",
-			dstType: "docker",
-			caFile:  caCertFile,
+			src:     "docker-daemon:alpine",
+			dsts:    []string{"docker-daemon:myalpine"},
+			caFiles: []string{caCertFile},
 		})
 		if err != nil {
 			t.Fatal(err)
@@ -222,11 +220,9 @@ func TestAddCA(t *testing.T) {
 		pull(t, pool.Client, "debian", "latest")
 
 		err = injectCA(&opts{
-			src:     "debian",
-			dst:     "mydebian",
-			srcType: "docker",
-			dstType: "docker",
-			caFile:  caCertFile,
+			src:     "docker-daemon:debian",
+			dsts:    []string{"docker-daemon:mydebian"},
+			caFiles: []string{caCertFile},
 		})
 		if err != nil {
 			t.Fatal(err)
@@ -255,11 +251,9 @@ func TestAddCA(t *testing.T) {
 		pull(t, pool.Client, "ubuntu", "latest")
 
 		err = injectCA(&opts{
-			src:     "ubuntu",
-			dst:     "myubuntu",
-			srcType: "docker",
-			dstType: "docker",
-			caFile:  caCertFile,
+			src:     "docker-daemon:ubuntu",
+			dsts:    []string{"docker-daemon:myubuntu"},
+			caFiles: []string{caCertFile},
 		})
 		if err != nil {
 			t.Fatal(err)
@@ -290,11 +284,9 @@ func TestAddCA(t *testing.T) {
 			pull(t, pool.Client, "rockylinux", v)
 
 			err = injectCA(&opts{
-				src:     "rockylinux:" + v,
-				dst:     "myrockylinux:" + v,
-				srcType: "docker",
-				dstType: "docker",
-				caFile:  caCertFile,
+				src:     "docker-daemon:rockylinux:" + v,
+				dsts:    []string{"docker-daemon:myrockylinux:" + v},
+				caFiles: []string{caCertFile},
 			})
 			if err != nil {
 				t.Fatal(err)
@@ -3,7 +3,7 @@ package main
 // adapted from: https://github.com/zcalusic/sysinfo/blob/30169cfb37112a562cbf9133494a323764ad852c/os.go#L32
 
 import (
-	"io"
+	"io/fs"
 	"regexp"
 	"strings"
 )
@@ -25,28 +25,20 @@ var (
 	reRedHat     = regexp.MustCompile(`[\( ]([\d\.]+)`)
 )
 
-func readFile(img *image, path string) string {
-	rc, err := img.open(path[1:])
-	if err != nil {
-		return ""
-	}
-
-	defer rc.Close()
-
-	data, err := io.ReadAll(rc)
+func readFile(fsys fs.FS, path string) string {
+	data, err := fs.ReadFile(fsys, path[1:])
 	if err != nil {
 		return ""
 	}
 	return strings.TrimSpace(string(data))
 }
 
-func fileExists(img *image, path string) bool {
-	path = path[1:]
-	_, ok := img.getMeta(path)
-	return ok
+func fileExists(fsys fs.FS, path string) bool {
+	_, err := fs.Stat(fsys, path[1:])
+	return err == nil
 }
 
-func getOSInfo(img *image) *osInfo {
+func getOSInfo(img fs.FS) *osInfo {
 	oi := &osInfo{}
 	// This seems to be the best and most portable way to detect OS architecture (NOT kernel!)
 	if fileExists(img, "/lib64/ld-linux-x86-64.so.2") {
@@ -56,6 +48,9 @@ func getOSInfo(img *image) *osInfo {
 	}
 
 	osRelease := readFile(img, "/etc/os-release")
+	if osRelease == "" {
+		osRelease = readFile(img, "/usr/lib/os-release")
+	}
 	if osRelease == "" {
 		return nil
 	}
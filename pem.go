@@ -2,49 +2,74 @@ package main
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"log/slog"
 	"path/filepath"
+	"sort"
 	"time"
-
-	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
-func patchPEMTruststore(pem []byte) patchFn {
-	return func(i *image) ([]v1.Layer, error) {
-		truststores := map[string]*tar.Header{}
-		for _, certFile := range certFiles {
-			certFile := certFile[1:]
-			hdr, ok := i.resolve(certFile)
-			if !ok {
-				continue
-			}
-			truststores[hdr.Name] = hdr
-		}
-
-		layers := []v1.Layer{}
-		now := time.Now()
-		for path, hdr := range truststores {
-			slog.Info("prepare PEM truststore", "file", path)
-			r, err := i.open(path)
+// patchPEMTruststore appends the CAs to the PEM bundles of the system
+// truststore. CAs which a bundle already contains are skipped.
+func patchPEMTruststore(cas []*caCert, modTime time.Time) patchFn {
+	return func(fsys fs.FS) ([]*fileChange, error) {
+		changes := []*fileChange{}
+		for _, hdr := range findPEMTruststores(fsys) {
+			slog.Info("prepare PEM truststore", "file", hdr.Name)
+			oldContent, err := fs.ReadFile(fsys, hdr.Name)
 			if err != nil {
 				return nil, err
 			}
-			defer r.Close()
-			oldContent, err := io.ReadAll(r)
-			if err != nil {
-				return nil, err
+
+			missing, trusted := splitTrusted(cas, pemFingerprints(oldContent), hdr.Name)
+			if len(missing) == 0 {
+				changes = append(changes, &fileChange{
+					hdr:       hdr,
+					storeType: storePEMBundle,
+					trusted:   trusted,
+					unchanged: true,
+				})
+				continue
 			}
 
-			layer, err := newLayer(hdr, now, append(oldContent, pem...))
-			if err != nil {
-				return nil, err
+			content := oldContent
+			if len(content) > 0 && content[len(content)-1] != '\n' {
+				content = append(content, '\n')
+			}
+			for _, ca := range missing {
+				content = append(content, ca.pem()...)
 			}
-			layers = append(layers, layer)
+
+			newHdr := *hdr
+			newHdr.ModTime = modTime
+			changes = append(changes, &fileChange{
+				hdr:       &newHdr,
+				content:   content,
+				storeType: storePEMBundle,
+				trusted:   trusted,
+			})
+		}
+		return changes, nil
+	}
+}
+
+// findPEMTruststores returns the headers of the existing PEM bundles of the
+// system truststore (see certFiles).
+func findPEMTruststores(fsys fs.FS) []*tar.Header {
+	// several cert files can be links to the same file
+	truststores := []*tar.Header{}
+	seen := map[string]bool{}
+	for _, certFile := range certFiles {
+		hdr, err := fileHeader(fsys, certFile[1:])
+		if err != nil || hdr.Typeflag != tar.TypeReg || seen[hdr.Name] {
+			continue
 		}
-		return layers, nil
+		seen[hdr.Name] = true
+		truststores = append(truststores, hdr)
 	}
+	return truststores
 }
 
 var customCertLocations = map[string]string{
@@ -54,6 +79,16 @@ var customCertLocations = map[string]string{
 	"/usr/share/pki/trust/anchors":              "%s.pem",
 }
 
+// sortedLocations returns the directories of customCertLocations sorted.
+func sortedLocations() []string {
+	locations := []string{}
+	for path := range customCertLocations {
+		locations = append(locations, path)
+	}
+	sort.Strings(locations)
+	return locations
+}
+
 var distroPathes = map[string]string{
 	"alpine": "/usr/local/share/ca-certificates",
 	"debian": "/usr/local/share/ca-certificates",
@@ -61,78 +96,140 @@ var distroPathes = map[string]string{
 	// TODO: extend with other vendors
 }
 
-func putPEMTruststore(name string, pem []byte) patchFn {
-	return func(i *image) ([]v1.Layer, error) {
+// putPEMTruststore puts a file per CA into the directories for custom CAs.
+// If none of them exists, the directory of the detected OS is used.
+func putPEMTruststore(cas []*caCert, modTime time.Time) patchFn {
+	return func(fsys fs.FS) ([]*fileChange, error) {
 
-		layers := []v1.Layer{}
-		now := time.Now()
-		for path, fileFormat := range customCertLocations {
-			_, ok := i.getMeta(path[1:])
-			if !ok {
+		changes := []*fileChange{}
+		for _, path := range sortedLocations() {
+			fileFormat := customCertLocations[path]
+			dir, err := fileHeader(fsys, path[1:])
+			if err != nil || dir.Typeflag != tar.TypeDir {
 				continue
 			}
 
-			fileName := fmt.Sprintf(fileFormat, name)
-			filePath := filepath.Join(path[1:], fileName)
-
-			hdr := &tar.Header{
-				Typeflag: tar.TypeReg,
-				Name:     filePath,
-				Size:     int64(len(pem)),
-				Mode:     0644,
-				Uid:      0,
-				Gid:      0,
-				ModTime:  now,
-			}
-
-			slog.Info("add custom PEM truststore", "file", hdr.Name)
-			layer, err := newLayer(hdr, now, pem)
+			anchors, err := anchorChanges(fsys, dir.Name, fileFormat, cas, modTime)
 			if err != nil {
 				return nil, err
 			}
-			layers = append(layers, layer)
-
+			changes = append(changes, anchors...)
 		}
 
-		if len(layers) != 0 {
-			return layers, nil
+		if len(changes) != 0 {
+			return changes, nil
 		}
 
 		// try to detect distro
 
-		osInfo := getOSInfo(i)
+		osInfo := getOSInfo(fsys)
 		if osInfo == nil {
 			slog.Info("no pem truststores found and no OS detected")
-			return layers, nil
+			return changes, nil
 		}
 
 		path, ok := distroPathes[osInfo.Vendor]
 		if !ok {
-			return layers, nil
+			return changes, nil
 		}
 
 		fileFormat := customCertLocations[path]
 
-		fileName := fmt.Sprintf(fileFormat, name)
-		filePath := filepath.Join(path[1:], fileName)
-
-		hdr := &tar.Header{
-			Typeflag: tar.TypeReg,
-			Name:     filePath,
-			Size:     int64(len(pem)),
-			Mode:     0644,
-			Uid:      0,
-			Gid:      0,
-			ModTime:  now,
+		// the directory does not exist, but its parent directories could be
+		// symlinks
+		dir, err := resolveNewPath(fsys, path[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to create custom PEM truststore '%s': %w", path, err)
+		}
+
+		slog.Info("add custom PEM truststore for detected OS", "os", osInfo.Vendor, "dir", dir, "path", path)
+		return anchorChanges(fsys, dir, fileFormat, cas, modTime)
+	}
+}
+
+// anchorChanges returns the changes which put a file per CA into the anchor
+// directory dir. CAs which one of the existing anchors already contains are
+// skipped. Existing anchors with the same name are not overwritten.
+func anchorChanges(fsys fs.FS, dir, fileFormat string, cas []*caCert, modTime time.Time) ([]*fileChange, error) {
+	anchors, err := readAnchors(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []*fileChange{}
+	trusted := map[string][]*caCert{}
+	for _, ca := range cas {
+		if file, ok := anchors[ca.fingerprint()]; ok {
+			logTrusted(file, ca)
+			trusted[file] = append(trusted[file], ca)
+			continue
 		}
-		slog.Info("add custom PEM truststore for detected OS", "os", osInfo.Vendor, "file", hdr.Name, "path", path)
 
-		layer, err := newLayer(hdr, now, pem)
+		name := ca.name
+		for i := 2; ; i++ {
+			_, err := fs.Stat(fsys, filepath.Join(dir, fmt.Sprintf(fileFormat, name)))
+			if err != nil {
+				break
+			}
+			name = fmt.Sprintf("%s-%d", ca.name, i)
+		}
+		hdr := newFileHeader(fsys, filepath.Join(dir, fmt.Sprintf(fileFormat, name)), modTime)
+
+		slog.Info("add custom PEM truststore", "file", hdr.Name)
+		changes = append(changes, &fileChange{
+			hdr:       hdr,
+			content:   ca.pem(),
+			storeType: storeAnchor,
+			created:   true,
+		})
+	}
+
+	files := []string{}
+	for file := range trusted {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		hdr, err := fileHeader(fsys, file)
 		if err != nil {
 			return nil, err
 		}
-		layers = append(layers, layer)
+		changes = append(changes, &fileChange{
+			hdr:       hdr,
+			storeType: storeAnchor,
+			trusted:   trusted[file],
+			unchanged: true,
+		})
+	}
+	return changes, nil
+}
 
-		return layers, nil
+// readAnchors returns the files of the anchor directory dir by the
+// fingerprints of the certificates they contain. Files which can not be read
+// are ignored.
+func readAnchors(fsys fs.FS, dir string) (map[string]string, error) {
+	anchors := map[string]string{}
+	entries, err := fs.ReadDir(fsys, dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return anchors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		file := filepath.Join(dir, e.Name())
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			continue
+		}
+		certs, err := parseCertificates(data, "")
+		if err != nil {
+			slog.Info("skip invalid anchor", "file", file, "err", err)
+			continue
+		}
+		for fingerprint := range certFingerprints(certs) {
+			anchors[fingerprint] = file
+		}
 	}
+	return anchors, nil
 }
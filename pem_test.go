@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestPatchPEMTruststore(t *testing.T) {
+	cas := []*caCert{newTestCA(t, "myca"), newTestCA(t, "issuing")}
+
+	fsys := fstest.MapFS{
+		"etc/ssl/certs/ca-certificates.crt":         {Data: []byte("existing"), Mode: 0644},
+		"usr/local/share/ca-certificates":           {Mode: 0755 | fs.ModeDir},
+		"usr/local/share/ca-certificates/other.crt": {Data: []byte("other"), Mode: 0640},
+	}
+
+	changes, err := patchPEMTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := putPEMTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = append(changes, anchors...)
+	if len(changes) != 3 {
+		t.Fatalf("got %d changes, want 3", len(changes))
+	}
+
+	bundle := changes[0]
+	if bundle.hdr.Name != "etc/ssl/certs/ca-certificates.crt" || bundle.storeType != storePEMBundle || bundle.created {
+		t.Errorf("unexpected bundle change: %+v", bundle)
+	}
+	want := append([]byte("existing\n"), cas[0].pem()...)
+	want = append(want, cas[1].pem()...)
+	if !bytes.Equal(bundle.content, want) {
+		t.Errorf("unexpected bundle content: %s", bundle.content)
+	}
+
+	for i, anchor := range changes[1:] {
+		if anchor.hdr.Name != "usr/local/share/ca-certificates/"+cas[i].name+".crt" || anchor.storeType != storeAnchor || !anchor.created {
+			t.Errorf("unexpected anchor change: %+v", anchor)
+		}
+		if anchor.hdr.Mode != 0640 {
+			t.Errorf("got anchor mode %o, want the mode of the sibling", anchor.hdr.Mode)
+		}
+		if !bytes.Equal(anchor.content, cas[i].pem()) {
+			t.Errorf("unexpected anchor content: %s", anchor.content)
+		}
+	}
+}
+
+func TestPutPEMTruststoreDetectOS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/os-release": {Data: []byte("ID=alpine\nVERSION_ID=3.18.4\n")},
+	}
+
+	cas := []*caCert{newTestCA(t, "myca")}
+
+	changes, err := putPEMTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].hdr.Name != "usr/local/share/ca-certificates/myca.crt" {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+
+	changes, err = putPEMTruststore(cas, time.Time{})(fstest.MapFS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("unexpected changes without OS: %+v", changes)
+	}
+}
+
+func TestPatchPEMTruststoreAlreadyTrusted(t *testing.T) {
+	trusted := newTestCA(t, "trusted")
+	missing := newTestCA(t, "missing")
+	cas := []*caCert{trusted, missing}
+
+	fsys := fstest.MapFS{
+		"etc/ssl/certs/ca-certificates.crt":           {Data: trusted.pem()},
+		"etc/pki/tls/certs/ca-bundle.crt":             {Data: append(trusted.pem(), missing.pem()...)},
+		"usr/local/share/ca-certificates/corp.crt":    {Data: trusted.pem()},
+		"usr/local/share/ca-certificates/missing.crt": {Data: []byte("other")},
+		"usr/local/share/ca-certificates/invalid.crt": {Data: []byte("-----BEGIN CERTIFICATE-----\naW52YWxpZA==\n-----END CERTIFICATE-----\n")},
+	}
+
+	changes, err := patchPEMTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("got %d changes, want 2", len(changes))
+	}
+	for _, c := range changes {
+		switch c.hdr.Name {
+		case "etc/ssl/certs/ca-certificates.crt":
+			if c.unchanged || len(c.trusted) != 1 || c.trusted[0] != trusted {
+				t.Errorf("%s: unexpected change: %+v", c.hdr.Name, c)
+			}
+			if !bytes.Equal(c.content, append(trusted.pem(), missing.pem()...)) {
+				t.Errorf("%s: unexpected content: %s", c.hdr.Name, c.content)
+			}
+		case "etc/pki/tls/certs/ca-bundle.crt":
+			if !c.unchanged || len(c.trusted) != 2 {
+				t.Errorf("%s: unexpected change: %+v", c.hdr.Name, c)
+			}
+		default:
+			t.Errorf("unexpected change %s", c.hdr.Name)
+		}
+	}
+
+	changes, err = putPEMTruststore(cas, time.Time{})(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("got %d anchor changes, want 2", len(changes))
+	}
+	// the existing missing.crt with another content is not overwritten
+	if changes[0].hdr.Name != "usr/local/share/ca-certificates/missing-2.crt" || changes[0].unchanged {
+		t.Errorf("unexpected anchor change: %+v", changes[0])
+	}
+	if changes[1].hdr.Name != "usr/local/share/ca-certificates/corp.crt" || !changes[1].unchanged || changes[1].trusted[0] != trusted {
+		t.Errorf("unexpected anchor change: %+v", changes[1])
+	}
+}
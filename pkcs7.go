@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
+
+// oidSignedData is the content type of PKCS#7 signed data. Certificate
+// chains (.p7b, .p7c) are signed data without content and signers.
+var oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// pkcs7ContentInfo is the ContentInfo of RFC 2315.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// pkcs7SignedData is the SignedData of RFC 2315. Only the certificates are
+// parsed.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// parsePKCS7Certificates returns the certificates of DER encoded PKCS#7
+// signed data.
+func parsePKCS7Certificates(der []byte) ([]*x509.Certificate, error) {
+	ci := &pkcs7ContentInfo{}
+	rest, err := asn1.Unmarshal(der, ci)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after PKCS#7 content info")
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("unsupported PKCS#7 content type %s", ci.ContentType)
+	}
+
+	sd := &pkcs7SignedData{}
+	_, err = asn1.Unmarshal(ci.Content.Bytes, sd)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
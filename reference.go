@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Transports of image references. The names and the syntax of the
+// references follow the transports of skopeo (see containers-transports(5)).
+const (
+	// docker://REFERENCE
+	transportRegistry = "docker"
+	// docker-daemon:REFERENCE
+	transportDaemon = "docker-daemon"
+	// docker-archive:PATH[:REFERENCE]
+	transportArchive = "docker-archive"
+	// oci:PATH[:TAG] or oci:PATH@DIGEST
+	transportOCI = "oci"
+)
+
+// unsupportedTransports are transports known from skopeo which are not
+// supported. They are listed to return a meaningful error instead of
+// interpreting them as registry references.
+var unsupportedTransports = []string{
+	"containers-storage",
+	"dir",
+	"oci-archive",
+	"ostree",
+	"sif",
+	"tarball",
+}
+
+// reference is a transport qualified image reference.
+type reference struct {
+	transport string
+
+	// location is the image reference for the docker and docker-daemon
+	// transport and the path for the docker-archive and oci transport.
+	location string
+
+	// tag is the optional reference of an image within a docker-archive
+	// (e.g. alpine:latest) or the tag or digest of an image in an OCI layout.
+	tag string
+}
+
+// parseReference parses a transport qualified image reference. References
+// without a transport are treated as registry references.
+func parseReference(s string) (*reference, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty image reference")
+	}
+
+	if location, ok := strings.CutPrefix(s, transportRegistry+"://"); ok {
+		if _, err := name.ParseReference(location); err != nil {
+			return nil, err
+		}
+		return &reference{transport: transportRegistry, location: location}, nil
+	}
+
+	if i := strings.Index(s, "://"); i != -1 && !strings.ContainsAny(s[:i], "/.") {
+		return nil, fmt.Errorf("unknown transport '%s' in '%s'", s[:i], s)
+	}
+
+	transport, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		transport = ""
+	}
+
+	switch transport {
+	case transportDaemon:
+		if _, err := name.ParseReference(rest); err != nil {
+			return nil, err
+		}
+		return &reference{transport: transportDaemon, location: rest}, nil
+
+	case transportArchive:
+		path, tag, _ := strings.Cut(rest, ":")
+		if path == "" {
+			return nil, fmt.Errorf("missing path in '%s'", s)
+		}
+		return &reference{transport: transportArchive, location: path, tag: tag}, nil
+
+	case transportOCI:
+		var path, tag string
+		if i := strings.Index(rest, "@"); i != -1 {
+			path, tag = rest[:i], rest[i+1:]
+		} else {
+			path, tag, _ = strings.Cut(rest, ":")
+		}
+		if path == "" {
+			return nil, fmt.Errorf("missing path in '%s'", s)
+		}
+		return &reference{transport: transportOCI, location: path, tag: tag}, nil
+	}
+
+	for _, t := range unsupportedTransports {
+		if transport == t {
+			return nil, fmt.Errorf("unsupported transport '%s' in '%s'", transport, s)
+		}
+	}
+
+	if _, err := name.ParseReference(s); err != nil {
+		return nil, fmt.Errorf("invalid reference '%s': %w", s, err)
+	}
+	return &reference{transport: transportRegistry, location: s}, nil
+}
+
+func (r *reference) String() string {
+	switch r.transport {
+	case transportRegistry:
+		return r.transport + "://" + r.location
+	case transportOCI:
+		if _, err := v1.NewHash(r.tag); err == nil {
+			return r.transport + ":" + r.location + "@" + r.tag
+		}
+	}
+	if r.tag != "" {
+		return r.transport + ":" + r.location + ":" + r.tag
+	}
+	return r.transport + ":" + r.location
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  reference
+	}{
+		{"alpine", reference{transport: transportRegistry, location: "alpine"}},
+		{"localhost:5000/alpine:3.18", reference{transport: transportRegistry, location: "localhost:5000/alpine:3.18"}},
+		{"docker://alpine:3.18", reference{transport: transportRegistry, location: "alpine:3.18"}},
+		{"docker-daemon:alpine:3.18", reference{transport: transportDaemon, location: "alpine:3.18"}},
+		{"docker-archive:images.tar", reference{transport: transportArchive, location: "images.tar"}},
+		{"docker-archive:images.tar:alpine:3.18", reference{transport: transportArchive, location: "images.tar", tag: "alpine:3.18"}},
+		{"oci:mirror", reference{transport: transportOCI, location: "mirror"}},
+		{"oci:mirror:3.18", reference{transport: transportOCI, location: "mirror", tag: "3.18"}},
+		{"oci:/x:alpine:3.18", reference{transport: transportOCI, location: "/x", tag: "alpine:3.18"}},
+		{"oci:mirror:registry.mycompany.com/alpine:3.18", reference{transport: transportOCI, location: "mirror", tag: "registry.mycompany.com/alpine:3.18"}},
+		{
+			"oci:mirror@sha256:2b0d1e9bb36d4c76a5d2a9e2f4c6b0a2b5e0e5d0cbd8e3b3d5c1e1f0b9a9c8d7",
+			reference{transport: transportOCI, location: "mirror", tag: "sha256:2b0d1e9bb36d4c76a5d2a9e2f4c6b0a2b5e0e5d0cbd8e3b3d5c1e1f0b9a9c8d7"},
+		},
+	} {
+		got, err := parseReference(tc.input)
+		if err != nil {
+			t.Errorf("%s: %s", tc.input, err)
+			continue
+		}
+		if *got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.input, *got, tc.want)
+		}
+		if strings.HasPrefix(tc.input, transportOCI+":") && got.String() != tc.input {
+			t.Errorf("%s: got String() '%s'", tc.input, got.String())
+		}
+		again, err := parseReference(got.String())
+		if err != nil || *again != *got {
+			t.Errorf("%s: String() '%s' does not round trip", tc.input, got.String())
+		}
+	}
+
+	for _, input := range []string{
+		"",
+		"foo://alpine",
+		"dir:/tmp/alpine",
+		"containers-storage:alpine",
+		"docker-archive:",
+		"oci::latest",
+		"docker-daemon:INVALID",
+	} {
+		_, err := parseReference(input)
+		if err == nil {
+			t.Errorf("%s: expected error", input)
+		}
+	}
+}
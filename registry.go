@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// registryOptions configure the connections to registries. They are used for
+// pull and push.
+type registryOptions struct {
+	// caFile is a PEM bundle with additional CAs to verify the TLS
+	// certificates of registries.
+	caFile string
+
+	// insecure is a list of registries (host[:port]) which are accessed
+	// without TLS verification and may be accessed via plain HTTP.
+	insecure stringList
+
+	// clientCert and clientKey are used for TLS client authentication.
+	clientCert string
+	clientKey  string
+
+	// retries is the number of retries of failed requests. The delay
+	// between the retries starts with retryDelay and gets tripled after
+	// each retry.
+	retries    int
+	retryDelay time.Duration
+
+	userAgent string
+}
+
+func (ro *registryOptions) isInsecure(registry string) bool {
+	for _, r := range ro.insecure {
+		if r == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReference parses a registry reference. References to insecure
+// registries may use plain HTTP.
+func (ro *registryOptions) parseReference(s string) (name.Reference, error) {
+	ref, err := name.ParseReference(s)
+	if err != nil {
+		return nil, err
+	}
+	if !ro.isInsecure(ref.Context().RegistryStr()) {
+		return ref, nil
+	}
+	return name.ParseReference(s, name.Insecure)
+}
+
+func (ro *registryOptions) transport(registry string) (http.RoundTripper, error) {
+	t := remote.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if ro.caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		caPEM, err := os.ReadFile(ro.caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in registry CA file '%s'", ro.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if ro.clientCert != "" || ro.clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(ro.clientCert, ro.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if ro.isInsecure(registry) {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+func makeOptions(ro *registryOptions, creds *credentials, ref name.Reference) ([]remote.Option, error) {
+	t, err := ro.transport(ref.Context().RegistryStr())
+	if err != nil {
+		return nil, err
+	}
+
+	options := []remote.Option{
+		remote.WithAuthFromKeychain(creds.keychain()),
+		remote.WithTransport(t),
+	}
+
+	if ro.retries >= 0 {
+		options = append(options, remote.WithRetryBackoff(remote.Backoff{
+			Duration: ro.retryDelay,
+			Factor:   3.0,
+			Jitter:   0.1,
+			Steps:    ro.retries + 1,
+		}))
+	}
+
+	if ro.userAgent != "" {
+		options = append(options, remote.WithUserAgent(ro.userAgent))
+	}
+
+	return options, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pavel-v-chernykh/keystore-go/v4"
+)
+
+// caSelector selects the CAs which are removed from the truststores.
+type caSelector struct {
+	fingerprints map[string]bool
+	subjects     map[string]bool
+}
+
+// newCASelector returns a selector for the CAs cas, the SHA-256 fingerprints
+// (hex, optionally separated by colons) and the subjects (e.g. CN=My
+// CA,O=Corp as printed by the injector).
+func newCASelector(cas []*caCert, fingerprints, subjects []string) (*caSelector, error) {
+	s := &caSelector{
+		fingerprints: map[string]bool{},
+		subjects:     map[string]bool{},
+	}
+	for _, ca := range cas {
+		s.fingerprints[ca.fingerprint()] = true
+	}
+	for _, f := range fingerprints {
+		fingerprint := strings.ToLower(strings.ReplaceAll(f, ":", ""))
+		raw, err := hex.DecodeString(fingerprint)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("invalid SHA-256 fingerprint '%s'", f)
+		}
+		s.fingerprints[fingerprint] = true
+	}
+	for _, subject := range subjects {
+		s.subjects[subject] = true
+	}
+	if len(s.fingerprints) == 0 && len(s.subjects) == 0 {
+		return nil, fmt.Errorf("no CA to remove selected")
+	}
+	return s, nil
+}
+
+func (s *caSelector) matches(cert *x509.Certificate) bool {
+	return s.fingerprints[fingerprint(cert)] || s.subjects[cert.Subject.String()]
+}
+
+// sortedFingerprints returns the selected fingerprints sorted.
+func (s *caSelector) sortedFingerprints() []string {
+	return sortedKeys(s.fingerprints)
+}
+
+// sortedSubjects returns the selected subjects sorted.
+func (s *caSelector) sortedSubjects() []string {
+	return sortedKeys(s.subjects)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func logRemoved(file string, ca *caCert) {
+	slog.Info("remove CA", "file", file, "subject", ca.cert.Subject, "fingerprint", ca.fingerprint())
+}
+
+// removePEMTruststore removes the selected CAs from the PEM bundles of the
+// system truststore.
+func removePEMTruststore(sel *caSelector, modTime time.Time) patchFn {
+	return func(fsys fs.FS) ([]*fileChange, error) {
+		changes := []*fileChange{}
+		for _, hdr := range findPEMTruststores(fsys) {
+			oldContent, err := fs.ReadFile(fsys, hdr.Name)
+			if err != nil {
+				return nil, err
+			}
+			content, removed := removePEMCertificates(oldContent, sel)
+			if len(removed) == 0 {
+				continue
+			}
+			for _, ca := range removed {
+				logRemoved(hdr.Name, ca)
+			}
+
+			newHdr := *hdr
+			newHdr.ModTime = modTime
+			changes = append(changes, &fileChange{
+				hdr:       &newHdr,
+				content:   content,
+				storeType: storePEMBundle,
+				removed:   removed,
+			})
+		}
+		return changes, nil
+	}
+}
+
+var (
+	pemCertBegin = []byte("-----BEGIN CERTIFICATE-----")
+	pemCertEnd   = []byte("-----END CERTIFICATE-----")
+)
+
+// removePEMCertificates removes the selected certificates from data. Other
+// content (e.g. comments) is kept as is.
+func removePEMCertificates(data []byte, sel *caSelector) ([]byte, []*caCert) {
+	out := []byte{}
+	removed := []*caCert{}
+	rest := data
+	for {
+		begin := bytes.Index(rest, pemCertBegin)
+		if begin < 0 {
+			break
+		}
+		end := bytes.Index(rest[begin:], pemCertEnd)
+		if end < 0 {
+			break
+		}
+		end += begin + len(pemCertEnd)
+		// the line break belongs to the certificate
+		if bytes.HasPrefix(rest[end:], []byte("\r\n")) {
+			end += 2
+		} else if bytes.HasPrefix(rest[end:], []byte("\n")) {
+			end++
+		}
+
+		block, _ := pem.Decode(rest[begin:end])
+		var cert *x509.Certificate
+		if block != nil {
+			cert, _ = x509.ParseCertificate(block.Bytes)
+		}
+		if cert == nil || !sel.matches(cert) {
+			out = append(out, rest[:end]...)
+			rest = rest[end:]
+			continue
+		}
+		out = append(out, rest[:begin]...)
+		removed = append(removed, &caCert{cert: cert})
+		rest = rest[end:]
+	}
+	return append(out, rest...), removed
+}
+
+// removeAnchors removes the selected CAs from the directories for custom
+// CAs. Files which only contain selected CAs are deleted with a whiteout.
+func removeAnchors(sel *caSelector, modTime time.Time) patchFn {
+	return func(fsys fs.FS) ([]*fileChange, error) {
+		changes := []*fileChange{}
+		for _, location := range sortedLocations() {
+			dir, err := fileHeader(fsys, location[1:])
+			if err != nil || dir.Typeflag != tar.TypeDir {
+				continue
+			}
+			entries, err := fs.ReadDir(fsys, dir.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				file := filepath.Join(dir.Name, e.Name())
+				data, err := fs.ReadFile(fsys, file)
+				if err != nil {
+					continue
+				}
+				certs, err := parseCertificates(data, "")
+				if err != nil {
+					continue
+				}
+				keep := []byte{}
+				removed := []*caCert{}
+				for _, cert := range certs {
+					if !sel.matches(cert) {
+						keep = append(keep, (&caCert{cert: cert}).pem()...)
+						continue
+					}
+					ca := &caCert{cert: cert}
+					logRemoved(file, ca)
+					removed = append(removed, ca)
+				}
+				if len(removed) == 0 {
+					continue
+				}
+
+				// the anchor itself is removed, not the target of a
+				// symlink
+				if len(removed) == len(certs) {
+					changes = append(changes, &fileChange{
+						hdr: &tar.Header{
+							Name:    file,
+							ModTime: modTime,
+						},
+						storeType: storeAnchor,
+						removed:   removed,
+						deleted:   true,
+					})
+					continue
+				}
+
+				hdr, err := fileHeader(fsys, file)
+				if err != nil {
+					return nil, err
+				}
+				hdr.ModTime = modTime
+				changes = append(changes, &fileChange{
+					hdr:       hdr,
+					content:   keep,
+					storeType: storeAnchor,
+					removed:   removed,
+				})
+			}
+		}
+		return changes, nil
+	}
+}
+
+// removeJKSTruststore removes the selected CAs from the java truststores.
+func removeJKSTruststore(sel *caSelector, modTime time.Time) patchFn {
+	return func(fsys fs.FS) ([]*fileChange, error) {
+		truststores, err := findJavaTruststores(fsys)
+		if err != nil {
+			return nil, err
+		}
+
+		changes := []*fileChange{}
+		for _, hdr := range truststores {
+			oldContent, err := fs.ReadFile(fsys, hdr.Name)
+			if err != nil {
+				return nil, err
+			}
+			newContent, removed, err := removeFromJavaTruststore(oldContent, sel)
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove CAs from java truststore '%s': %w", hdr.Name, err)
+			}
+			if len(removed) == 0 {
+				continue
+			}
+			for _, ca := range removed {
+				logRemoved(hdr.Name, ca)
+			}
+
+			newHdr := *hdr
+			newHdr.ModTime = modTime
+			changes = append(changes, &fileChange{
+				hdr:       &newHdr,
+				content:   newContent,
+				storeType: javaStoreType(oldContent),
+				removed:   removed,
+			})
+		}
+		return changes, nil
+	}
+}
+
+// removeFromJavaTruststore removes the selected certificates from a JKS or
+// PKCS12 truststore. The removed certificates of a JKS have their alias as
+// name.
+func removeFromJavaTruststore(content []byte, sel *caSelector) ([]byte, []*caCert, error) {
+	removed := []*caCert{}
+	if javaStoreType(content) == storePKCS12 {
+		certs, password, err := decodePKCS12Truststore(content, "changeit")
+		if err != nil {
+			return nil, nil, err
+		}
+		keep := []*x509.Certificate{}
+		for _, cert := range certs {
+			if sel.matches(cert) {
+				removed = append(removed, &caCert{cert: cert})
+				continue
+			}
+			keep = append(keep, cert)
+		}
+		if len(removed) == 0 {
+			return content, removed, nil
+		}
+		newContent, err := encodePKCS12Truststore(keep, password)
+		return newContent, removed, err
+	}
+
+	ks := keystore.New(keystore.WithOrderedAliases())
+	err := ks.Load(bytes.NewReader(content), []byte("changeit"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load java key store: %w", err)
+	}
+	for _, alias := range ks.Aliases() {
+		if !ks.IsTrustedCertificateEntry(alias) {
+			continue
+		}
+		cert, err := trustedCertificate(ks, alias)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !sel.matches(cert) {
+			continue
+		}
+		ks.DeleteEntry(alias)
+		removed = append(removed, &caCert{name: alias, cert: cert})
+	}
+	if len(removed) == 0 {
+		return content, removed, nil
+	}
+
+	newJKS := &bytes.Buffer{}
+	err = ks.Store(newJKS, []byte("changeit"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return newJKS.Bytes(), removed, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/pavel-v-chernykh/keystore-go/v4"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestNewCASelector(t *testing.T) {
+	ca := newTestCA(t, "myca")
+	fingerprint := ca.fingerprint()
+
+	colons := []string{}
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	sel, err := newCASelector(nil, []string{strings.Join(colons, ":")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sel.matches(ca.cert) {
+		t.Error("CA does not match its fingerprint")
+	}
+
+	sel, err = newCASelector(nil, nil, []string{"CN=myca"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sel.matches(ca.cert) || sel.matches(newTestCA(t, "other").cert) {
+		t.Error("unexpected subject match")
+	}
+
+	_, err = newCASelector(nil, []string{"abc"}, nil)
+	if err == nil {
+		t.Error("expected error for invalid fingerprint")
+	}
+	_, err = newCASelector(nil, nil, nil)
+	if err == nil {
+		t.Error("expected error without selected CAs")
+	}
+}
+
+func TestRemovePEMCertificates(t *testing.T) {
+	keep := newTestCA(t, "keep")
+	remove := newTestCA(t, "remove")
+	sel, err := newCASelector([]*caCert{remove}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("# keep\n" + string(keep.pem()) + "# remove\n" + string(remove.pem()) + "# end\n")
+	content, removed := removePEMCertificates(data, sel)
+	want := "# keep\n" + string(keep.pem()) + "# remove\n# end\n"
+	if string(content) != want {
+		t.Errorf("got\n%s\nwant\n%s", content, want)
+	}
+	if len(removed) != 1 || !removed[0].cert.Equal(remove.cert) {
+		t.Errorf("unexpected removed CAs: %v", removed)
+	}
+
+	content, removed = removePEMCertificates(keep.pem(), sel)
+	if !bytes.Equal(content, keep.pem()) || len(removed) != 0 {
+		t.Error("content without selected CAs changed")
+	}
+}
+
+func TestRemoveTruststores(t *testing.T) {
+	keep := newTestCA(t, "keep")
+	remove := newTestCA(t, "remove")
+	sel, err := newCASelector([]*caCert{remove}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := keystore.New()
+	for _, ca := range []*caCert{keep, remove} {
+		err := ks.SetTrustedCertificateEntry(ca.name, keystore.TrustedCertificateEntry{
+			Certificate: keystore.Certificate{Type: "X509", Content: ca.cert.Raw},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	jks := &bytes.Buffer{}
+	err = ks.Store(jks, []byte("changeit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := pkcs12.Passwordless.EncodeTrustStore([]*x509.Certificate{keep.cert, remove.cert}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12Password, err := pkcs12.LegacyRC2.EncodeTrustStore([]*x509.Certificate{keep.cert, remove.cert}, "changeit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fstest.MapFS{
+		"etc/ssl/certs/ca-certificates.crt":          {Data: append(keep.pem(), remove.pem()...)},
+		"usr/local/share/ca-certificates/remove.crt": {Data: remove.pem()},
+		"usr/local/share/ca-certificates/both.crt":   {Data: append(keep.pem(), remove.pem()...)},
+		"usr/local/share/ca-certificates/keep.crt":   {Data: keep.pem()},
+		"usr/lib/jvm/java-11/lib/security/cacerts":   {Data: jks.Bytes()},
+		"opt/java/openjdk/lib/security/cacerts":      {Data: p12},
+		"opt/java/jre/lib/security/cacerts":          {Data: p12Password},
+	}
+
+	changes := []*fileChange{}
+	for _, patch := range []patchFn{
+		removePEMTruststore(sel, time.Time{}),
+		removeAnchors(sel, time.Time{}),
+		removeJKSTruststore(sel, time.Time{}),
+	} {
+		c, err := patch(fsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, c...)
+	}
+
+	got := map[string]*fileChange{}
+	for _, c := range changes {
+		got[c.hdr.Name] = c
+		if len(c.removed) != 1 || !c.removed[0].cert.Equal(remove.cert) {
+			t.Errorf("%s: unexpected removed CAs", c.hdr.Name)
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("got %d changes, want 6", len(got))
+	}
+
+	if c := got["etc/ssl/certs/ca-certificates.crt"]; c == nil || !bytes.Equal(c.content, keep.pem()) {
+		t.Error("CA not removed from bundle")
+	}
+	if c := got["usr/local/share/ca-certificates/remove.crt"]; c == nil || !c.deleted {
+		t.Error("anchor not deleted")
+	}
+	if c := got["usr/local/share/ca-certificates/both.crt"]; c == nil || c.deleted || !bytes.Equal(c.content, keep.pem()) {
+		t.Error("CA not removed from anchor bundle")
+	}
+	for _, name := range []string{"usr/lib/jvm/java-11/lib/security/cacerts", "opt/java/openjdk/lib/security/cacerts", "opt/java/jre/lib/security/cacerts"} {
+		c := got[name]
+		if c == nil {
+			t.Errorf("%s: CA not removed", name)
+			continue
+		}
+		certs, err := readJavaTruststore(c.content, "changeit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 1 || !certs[0].Equal(keep.cert) {
+			t.Errorf("%s: got %d certificates, want only the kept CA", name, len(certs))
+		}
+	}
+
+	// the password of a PKCS12 truststore is kept
+	if c := got["opt/java/jre/lib/security/cacerts"]; c != nil {
+		_, err := pkcs12.DecodeTrustStore(c.content, "changeit")
+		if err != nil {
+			t.Errorf("%s: %s", c.hdr.Name, err)
+		}
+	}
+}
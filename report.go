@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// report describes what a run did. It is written as JSON if requested with
+// -report.
+type report struct {
+	Source       sourceReport         `json:"source"`
+	Images       []*imageReport       `json:"images"`
+	Destinations []*destinationReport `json:"destinations"`
+}
+
+// newReport returns an empty report. The lists are empty instead of null,
+// also if all destinations are up to date and nothing is patched.
+func newReport() *report {
+	return &report{
+		Images:       []*imageReport{},
+		Destinations: []*destinationReport{},
+	}
+}
+
+type sourceReport struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+}
+
+// imageReport describes a patched image. For multi-platform sources there is
+// one per platform.
+type imageReport struct {
+	SourceDigest string         `json:"sourceDigest"`
+	Platform     string         `json:"platform,omitempty"`
+	OS           *osInfo        `json:"os,omitempty"`
+	Files        []*fileReport  `json:"files"`
+	Layers       []*layerReport `json:"layers"`
+	Digest       string         `json:"digest"`
+}
+
+type fileReport struct {
+	Path string `json:"path"`
+	// Type is one of pem-bundle, anchor, jks or pkcs12.
+	Type string `json:"type"`
+	// Action is created, patched, deleted (see -remove) or unchanged if
+	// the file already contained all CAs.
+	Action string `json:"action"`
+	// AlreadyTrusted are the CAs which the file already contained.
+	AlreadyTrusted []*caReport `json:"alreadyTrusted,omitempty"`
+	// Removed are the CAs which have been removed from the file.
+	Removed []*caReport `json:"removed,omitempty"`
+}
+
+type caReport struct {
+	Name        string `json:"name,omitempty"`
+	Subject     string `json:"subject"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type layerReport struct {
+	Digest    string `json:"digest"`
+	DiffID    string `json:"diffID"`
+	Size      int64  `json:"size"`
+	MediaType string `json:"mediaType"`
+}
+
+type destinationReport struct {
+	// Reference is the destination as specified (after the template
+	// evaluation).
+	Reference string `json:"reference"`
+	// Name is the full reference of the written image including the
+	// digest (e.g. registry.corp/alpine@sha256:...).
+	Name   string `json:"name,omitempty"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// UpToDate is true if the destination has not been written because
+	// it already contains the patched image.
+	UpToDate bool `json:"upToDate,omitempty"`
+}
+
+func (r *imageReport) addFiles(changes []*fileChange) {
+	for _, c := range changes {
+		action := "patched"
+		if c.created {
+			action = "created"
+		}
+		if c.unchanged {
+			action = "unchanged"
+		}
+		if c.deleted {
+			action = "deleted"
+		}
+		r.Files = append(r.Files, &fileReport{
+			Path:           "/" + c.hdr.Name,
+			Type:           c.storeType,
+			Action:         action,
+			AlreadyTrusted: newCAReports(c.trusted),
+			Removed:        newCAReports(c.removed),
+		})
+	}
+}
+
+func newCAReports(cas []*caCert) []*caReport {
+	reports := []*caReport{}
+	for _, ca := range cas {
+		reports = append(reports, &caReport{
+			Name:        ca.name,
+			Subject:     ca.cert.Subject.String(),
+			Fingerprint: ca.fingerprint(),
+		})
+	}
+	return reports
+}
+
+func (r *imageReport) addLayers(layers []v1.Layer) error {
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return err
+		}
+		r.Layers = append(r.Layers, &layerReport{
+			Digest:    digest.String(),
+			DiffID:    diffID.String(),
+			Size:      size,
+			MediaType: string(mediaType),
+		})
+	}
+	return nil
+}
+
+// write writes the report as JSON to path or to stdout if path is -.
+func (r *report) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
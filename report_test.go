@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestReportUpToDate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mirror")
+
+	caFile := filepath.Join(dir, "myca.crt")
+	err := os.WriteFile(caFile, newTestCA(t, "myca").pem(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putLayoutImage(path, "src", img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reportFile := filepath.Join(dir, "report.json")
+	for i := 0; i < 2; i++ {
+		err = injectCA(&opts{
+			src:     "oci:" + path + ":src",
+			dsts:    []string{"oci:" + path + ":patched"},
+			caFiles: []string{caFile},
+			report:  reportFile,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rep["images"]) != "[]" {
+		t.Errorf("got images %s, want []", rep["images"])
+	}
+	dsts := []*destinationReport{}
+	err = json.Unmarshal(rep["destinations"], &dsts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dsts) != 1 || !dsts[0].UpToDate {
+		t.Errorf("got destinations %s, want one up to date destination", rep["destinations"])
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// templateData is the data which is available in destination templates. For
+// the source docker.io/library/alpine:3.18 the fields are:
+//
+//	Registry:    index.docker.io
+//	Repository:  library/alpine
+//	Name:        alpine
+//	Tag:         3.18
+//	Digest:      sha256:48d9183eb12a05c99bcc0bf44a003607b8e941e1d4f41f9ad12bdcc4b5672f86
+//	ShortDigest: 48d9183eb12a
+type templateData struct {
+	Registry    string
+	Repository  string
+	Name        string
+	Tag         string
+	Digest      string
+	ShortDigest string
+}
+
+// newTemplateData returns the template data for a source image. src may be
+// nil if the source has no name (e.g. an untagged image in a docker-archive).
+func newTemplateData(src name.Reference, digest v1.Hash) *templateData {
+	data := &templateData{
+		Digest:      digest.String(),
+		ShortDigest: digest.Hex,
+	}
+	if len(data.ShortDigest) > 12 {
+		data.ShortDigest = data.ShortDigest[:12]
+	}
+
+	if src == nil {
+		return data
+	}
+
+	data.Registry = src.Context().RegistryStr()
+	data.Repository = src.Context().RepositoryStr()
+	data.Name = path.Base(data.Repository)
+	if tag, ok := src.(name.Tag); ok {
+		data.Tag = tag.TagStr()
+	}
+	return data
+}
+
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// expandTemplate evaluates a destination template.
+func expandTemplate(tmpl string, data *templateData) (string, error) {
+	t, err := template.New("destination").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination template '%s': %w", tmpl, err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = t.Execute(buf, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate destination template '%s': %w", tmpl, err)
+	}
+	return buf.String(), nil
+}
+
+// sourceName returns the image name of a source if it has one. srcName is
+// the name which getImage returned for the source reference ref.
+func sourceName(ref *reference, srcName string) name.Reference {
+	if ref.transport == transportOCI {
+		// in OCI layouts the reference is often only a tag, which we can
+		// not distinguish from a repository name.
+		_, err := v1.NewHash(srcName)
+		if err == nil || !strings.ContainsAny(srcName, "/:") {
+			return nil
+		}
+	}
+	if srcName == "" {
+		return nil
+	}
+	n, err := name.ParseReference(srcName)
+	if err != nil {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	digest, err := v1.NewHash("sha256:48d9183eb12a05c99bcc0bf44a003607b8e941e1d4f41f9ad12bdcc4b5672f86")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := name.ParseReference("docker.io/library/foo:1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := newTemplateData(src, digest)
+	for tmpl, want := range map[string]string{
+		"registry.corp/mirror/{{ .Name }}:{{ .Tag }}-corpca":   "registry.corp/mirror/foo:1.2-corpca",
+		"{{ .Registry }}/{{ .Repository }}:{{ .ShortDigest }}": "index.docker.io/library/foo:48d9183eb12a",
+		"oci:mirror:{{ .Name }}-{{ .ShortDigest }}":            "oci:mirror:foo-48d9183eb12a",
+	} {
+		got, err := expandTemplate(tmpl, data)
+		if err != nil {
+			t.Errorf("%s: %s", tmpl, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got '%s', want '%s'", tmpl, got, want)
+		}
+	}
+
+	_, err = expandTemplate("{{ .Unknown }}", data)
+	if err == nil {
+		t.Error("expected error for unknown field")
+	}
+}